@@ -1,7 +1,9 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
@@ -24,11 +26,42 @@ var (
 	FlagRunOnce         bool
 	FlagStatusAddr      = ":8087"
 	FlagExclude         []string
+	FlagExcludeFrom     []string
+	FlagExcludeSyntax   = sync.PatternSyntaxDoublestar
+	FlagRemoteIgnore    bool
 	FlagScratch         bool
 	FlagDefaultFileMode = "0664"
+	FlagDirMode         = "0777"
 	FlagS3Endpoint      = ""
 	FlagDisableSSL      = false
 	FlagPullInterval    = time.Second * 5
+	FlagMaxSize         = ""
+	FlagMinAge          time.Duration
+	FlagMaxAge          time.Duration
+	FlagPreserveMtime   bool
+	FlagPreservePerms   bool
+	FlagSymlinks        bool
+	FlagVerify          bool
+	FlagCompare         = sync.CompareETag
+	FlagSSECKeyFile     = ""
+	FlagDecryptKeyFile  = ""
+	FlagManifestKey     = ""
+	FlagManifestSync    bool
+	FlagCommitMarker    = ""
+	FlagAsOf            = ""
+	FlagHistoryDir      = ""
+	FlagHistoryCycles   = 10
+	FlagRollbackList    bool
+	FlagJSON            bool
+	FlagVerifyStrict    bool
+	FlagMaxCycleTime    = time.Hour
+	FlagMaxStaleness    time.Duration
+	FlagTrashDir        = ""
+	FlagNoDelete        bool
+	FlagDriftInterval   time.Duration
+	FlagDriftCompare    = sync.DriftCompareSizeMtime
+	FlagDriftAction     = sync.DriftActionReport
+	FlagTrashTTL        = time.Hour * 24 * 7
 
 	metricsSyncTime = prometheus.NewGauge(prometheus.GaugeOpts{
 		Namespace: "objinsync",
@@ -50,12 +83,249 @@ func healthCheckHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func serveHealthCheckEndpoints() {
+// loadSSECustomerKey reads SSE-C key from --sse-c-key-file or
+// OBJINSYNC_SSE_C_KEY environment variable, nil is returned if neither is set.
+func loadSSECustomerKey() ([]byte, error) {
+	var data []byte
+	if FlagSSECKeyFile != "" {
+		content, err := ioutil.ReadFile(FlagSSECKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read SSE-C key file: %v", err)
+		}
+		data = content
+	} else if env := os.Getenv("OBJINSYNC_SSE_C_KEY"); env != "" {
+		data = []byte(env)
+	} else {
+		return nil, nil
+	}
+	return sync.ParseSSECustomerKey(data)
+}
+
+// statusHandler serves status of the running and last pull as JSON.
+func statusHandler(puller *sync.Puller) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(puller.Status()); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	}
+}
+
+// livezHandler fails if the pull loop looks wedged so the process can be
+// restarted.
+func livezHandler(puller *sync.Puller) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		err := puller.Status().CheckLive(time.Now(), FlagPullInterval, FlagMaxCycleTime)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprintf(w, "GOOD")
+	}
+}
+
+// readyzHandler fails until the initial pull succeeds and whenever the last
+// successful pull is older than --max-staleness.
+func readyzHandler(puller *sync.Puller) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		err := puller.Status().CheckReady(time.Now(), FlagMaxStaleness)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprintf(w, "GOOD")
+	}
+}
+
+func serveHealthCheckEndpoints(puller *sync.Puller) {
 	http.HandleFunc("/health", healthCheckHandler)
+	http.HandleFunc("/livez", livezHandler(puller))
+	http.HandleFunc("/readyz", readyzHandler(puller))
+	http.HandleFunc("/status", statusHandler(puller))
 	http.Handle("/metrics", promhttp.Handler())
 	log.Fatal(http.ListenAndServe(FlagStatusAddr, nil))
 }
 
+// newPuller creates a puller from flags shared by commands comparing the
+// remote prefix with a local dir.
+func newPuller(cmd *cobra.Command, remoteUri string, localDir string) *sync.Puller {
+	puller, err := sync.NewPuller(remoteUri, localDir)
+	if err != nil {
+		log.Fatal(err)
+	}
+	puller.DisableSSL = FlagDisableSSL
+	puller.S3Endpoint = FlagS3Endpoint
+	puller.RemoteIgnore = FlagRemoteIgnore
+	puller.ManifestSync = FlagManifestSync
+	if FlagAsOf != "" {
+		asOf, err := time.Parse(time.RFC3339, FlagAsOf)
+		if err != nil {
+			log.Fatal("invalid --as-of time, expected RFC3339 format: ", err)
+		}
+		if FlagManifestSync || FlagCommitMarker != "" {
+			log.Fatal("--as-of can't be used with --manifest-sync or --commit-marker")
+		}
+		puller.AsOf = asOf
+	}
+	puller.Symlinks = FlagSymlinks
+	puller.MinAge = FlagMinAge
+	puller.MaxAge = FlagMaxAge
+	if FlagMaxSize != "" {
+		size, err := sync.ParseByteSize(FlagMaxSize)
+		if err != nil {
+			log.Fatal(err)
+		}
+		puller.MaxSize = size
+	}
+	if err := puller.SetPatternSyntax(FlagExcludeSyntax); err != nil {
+		log.Fatal(err)
+	}
+	if FlagExclude != nil {
+		puller.AddExcludePatterns(FlagExclude)
+	}
+	for _, f := range FlagExcludeFrom {
+		if err := puller.AddExcludeFile(f); err != nil {
+			log.Fatal(err)
+		}
+	}
+	sseCKey, err := loadSSECustomerKey()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if sseCKey != nil {
+		if err := puller.SetSSECustomerKey(sseCKey); err != nil {
+			log.Fatal(err)
+		}
+		// ETag is not MD5 of content for SSE-C encrypted objects
+		if !cmd.Flags().Changed("compare") {
+			FlagCompare = sync.CompareSHA256
+		} else if FlagCompare == sync.CompareETag {
+			log.Fatal("etag compare mode can't be used with SSE-C, use sha256 or size-mtime instead")
+		}
+	}
+	if FlagManifestKey != "" {
+		content, err := ioutil.ReadFile(FlagManifestKey)
+		if err != nil {
+			log.Fatal(err)
+		}
+		key, err := sync.ParseManifestPublicKey(content)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := puller.SetManifestPublicKey(key); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if err := puller.SetCompareMode(FlagCompare); err != nil {
+		log.Fatal(err)
+	}
+	return puller
+}
+
+// addPullerFlags registers flags read by newPuller.
+func addPullerFlags(cmd *cobra.Command) {
+	cmd.PersistentFlags().BoolVarP(
+		&FlagDisableSSL, "disable-ssl", "", false, "disable SSL for object storage connection")
+	cmd.PersistentFlags().StringSliceVarP(
+		&FlagExclude, "exclude", "e", nil, "exclude files matching given pattern, see https://github.com/bmatcuk/doublestar#patterns for pattern spec")
+	cmd.PersistentFlags().StringSliceVarP(
+		&FlagExcludeFrom, "exclude-from", "", nil, "read exclude patterns from given file, one pattern per line")
+	cmd.PersistentFlags().StringVarP(
+		&FlagExcludeSyntax,
+		"exclude-syntax",
+		"",
+		sync.PatternSyntaxDoublestar,
+		"syntax for exclude patterns, either doublestar or gitignore",
+	)
+	cmd.PersistentFlags().BoolVarP(
+		&FlagRemoteIgnore,
+		"remote-ignore",
+		"",
+		false,
+		"merge gitignore style patterns from "+sync.RemoteIgnoreFile+" object in the remote prefix with excludes on every pull",
+	)
+	cmd.PersistentFlags().StringVarP(
+		&FlagMaxSize, "max-size", "", "", "skip objects larger than given size (e.g. 100M, 1GiB)")
+	cmd.PersistentFlags().DurationVarP(
+		&FlagMinAge, "min-age", "", 0, "skip objects modified more recently than given duration")
+	cmd.PersistentFlags().DurationVarP(
+		&FlagMaxAge, "max-age", "", 0, "skip objects modified longer ago than given duration")
+	cmd.PersistentFlags().StringVarP(
+		&FlagCompare,
+		"compare",
+		"",
+		sync.CompareETag,
+		"strategy to detect changed files, one of etag (MD5), sha256 (S3 ChecksumSHA256) or size-mtime",
+	)
+	cmd.PersistentFlags().StringVarP(
+		&FlagSSECKeyFile,
+		"sse-c-key-file",
+		"",
+		"",
+		"file containing 256 bit SSE-C key (raw or base64), OBJINSYNC_SSE_C_KEY environment variable is used if not set",
+	)
+	cmd.PersistentFlags().StringVarP(
+		&FlagManifestKey,
+		"manifest-key",
+		"",
+		"",
+		"PEM encoded ed25519 or ECDSA public key, only apply pulls matching "+sync.ManifestFile+" signed with it",
+	)
+	cmd.PersistentFlags().BoolVarP(
+		&FlagManifestSync,
+		"manifest-sync",
+		"",
+		false,
+		"pull objects listed in "+sync.ManifestFile+" instead of listing the remote prefix",
+	)
+	cmd.PersistentFlags().StringVarP(
+		&FlagAsOf,
+		"as-of",
+		"",
+		"",
+		"pull object versions current at given RFC3339 time (e.g. 2026-10-01T12:00:00Z), requires bucket versioning",
+	)
+	cmd.PersistentFlags().BoolVarP(
+		&FlagSymlinks,
+		"symlinks",
+		"",
+		false,
+		"create symlinks from objects with x-amz-meta-symlink-target metadata or .rclonelink suffix",
+	)
+	cmd.PersistentFlags().StringVarP(
+		&FlagS3Endpoint, "s3-endpoint", "", "", "override endpoint to use for remote object store (e.g. minio)")
+}
+
+// printDiffEntries prints entries as JSON with --json or one per line.
+func printDiffEntries(entries []sync.DiffEntry) {
+	if FlagJSON {
+		printJSON(entries)
+		return
+	}
+	for _, entry := range entries {
+		fmt.Printf("%s\t%s\tsize: %d", entry.Status, entry.Path, entry.Size)
+		if entry.RemoteId != "" {
+			fmt.Printf("\tremote: %s", entry.RemoteId)
+		}
+		if entry.LocalId != "" {
+			fmt.Printf("\tlocal: %s", entry.LocalId)
+		}
+		if entry.Reason != "" {
+			fmt.Printf("\treason: %s", entry.Reason)
+		}
+		fmt.Println()
+	}
+}
+
+// printJSON prints v as indented JSON.
+func printJSON(v interface{}) {
+	out, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println(string(out))
+}
+
 func main() {
 	if os.Getenv("DEBUG") != "" {
 		logger, _ := zap.NewDevelopment()
@@ -101,14 +371,35 @@ func main() {
 			localDir := args[1]
 			interval := FlagPullInterval
 
-			puller, err := sync.NewPuller(remoteUri, localDir)
-			if err != nil {
-				log.Fatal(err)
+			puller := newPuller(cmd, remoteUri, localDir)
+			puller.CommitMarker = FlagCommitMarker
+			puller.NoDelete = FlagNoDelete
+			puller.PreserveMtime = FlagPreserveMtime
+			puller.PreservePerms = FlagPreservePerms
+			puller.Verify = FlagVerify
+			if FlagDecryptKeyFile != "" {
+				provider, err := sync.NewLocalKeyFileProvider(FlagDecryptKeyFile)
+				if err != nil {
+					log.Fatal(err)
+				}
+				puller.SetKeyProvider(provider)
+			}
+			if FlagHistoryDir != "" {
+				if err := puller.SetHistory(FlagHistoryDir, FlagHistoryCycles); err != nil {
+					log.Fatal(err)
+				}
+			}
+			if FlagTrashDir != "" {
+				if err := puller.SetTrash(FlagTrashDir, FlagTrashTTL); err != nil {
+					log.Fatal(err)
+				}
 			}
-			puller.DisableSSL = FlagDisableSSL
-			puller.S3Endpoint = FlagS3Endpoint
-			if FlagExclude != nil {
-				puller.AddExcludePatterns(FlagExclude)
+			if FlagDriftInterval > 0 {
+				// needs to be set before local checksums are populated
+				err := puller.SetDriftDetection(FlagDriftInterval, FlagDriftCompare, FlagDriftAction)
+				if err != nil {
+					log.Fatal(err)
+				}
 			}
 			if !FlagScratch {
 				puller.PopulateChecksum()
@@ -120,6 +411,13 @@ func main() {
 				}
 				puller.SetDefaultFileMode(os.FileMode(mode))
 			}
+			if FlagDirMode != "" {
+				mode, err := strconv.ParseInt(FlagDirMode, 8, 64)
+				if err != nil {
+					log.Fatal("invalid dir mode", err)
+				}
+				puller.SetDirMode(os.FileMode(mode))
+			}
 
 			pull := func() {
 				start := time.Now()
@@ -143,7 +441,7 @@ func main() {
 				pull()
 			} else {
 				InitialRunFinished.Store(false)
-				go serveHealthCheckEndpoints()
+				go serveHealthCheckEndpoints(puller)
 				l.Infof("Serving health check endpoints at: %s.", FlagStatusAddr)
 				l.Infof("Pulling from %s to %s every %v...", remoteUri, localDir, interval)
 				ticker := time.NewTicker(interval)
@@ -159,14 +457,11 @@ func main() {
 		},
 	}
 
+	addPullerFlags(pullCmd)
 	pullCmd.PersistentFlags().BoolVarP(
 		&FlagRunOnce, "once", "o", false, "run action once and then exit")
-	pullCmd.PersistentFlags().BoolVarP(
-		&FlagDisableSSL, "disable-ssl", "", false, "disable SSL for object storage connection")
 	pullCmd.PersistentFlags().StringVarP(
 		&FlagStatusAddr, "status-addr", "s", ":8087", "binding address for status endpoint")
-	pullCmd.PersistentFlags().StringSliceVarP(
-		&FlagExclude, "exclude", "e", nil, "exclude files matching given pattern, see https://github.com/bmatcuk/doublestar#patterns for pattern spec")
 	pullCmd.PersistentFlags().BoolVarP(
 		&FlagScratch,
 		"scratch",
@@ -174,13 +469,232 @@ func main() {
 		false,
 		"skip checksums calculation and override all files during the initial sync",
 	)
+	pullCmd.PersistentFlags().StringVarP(
+		&FlagDecryptKeyFile,
+		"decrypt-key-file",
+		"",
+		"",
+		"file with key id and base64 encoded 256 bit key per line used to decrypt envelope encrypted objects",
+	)
+	pullCmd.PersistentFlags().StringVarP(
+		&FlagCommitMarker,
+		"commit-marker",
+		"",
+		"",
+		"only apply changes when given object in the remote prefix (e.g. _SUCCESS) has changed since the last applied pull",
+	)
+	pullCmd.PersistentFlags().StringVarP(
+		&FlagHistoryDir,
+		"history-dir",
+		"",
+		"",
+		"keep previous versions of files replaced or deleted by pulls in given directory outside of LOCAL_PATH for rollback",
+	)
+	pullCmd.PersistentFlags().IntVarP(
+		&FlagHistoryCycles, "history-cycles", "", 10, "number of pull cycles to keep in history dir")
+	pullCmd.PersistentFlags().BoolVarP(
+		&FlagNoDelete,
+		"no-delete",
+		"",
+		false,
+		"never delete local files or empty directories, only report local files not present remotely",
+	)
+	pullCmd.PersistentFlags().StringVarP(
+		&FlagTrashDir,
+		"trash-dir",
+		"",
+		"",
+		"move deleted files into timestamped directories under given directory outside of LOCAL_PATH instead of removing them",
+	)
+	pullCmd.PersistentFlags().DurationVarP(
+		&FlagTrashTTL, "trash-ttl", "", time.Hour*24*7, "purge trash directories older than given duration, 0 keeps them forever")
+	pullCmd.PersistentFlags().DurationVarP(
+		&FlagDriftInterval,
+		"drift-check-interval",
+		"",
+		0,
+		"check local files for changes made outside of objinsync at given interval, 0 disables the check",
+	)
+	pullCmd.PersistentFlags().StringVarP(
+		&FlagDriftCompare,
+		"drift-compare",
+		"",
+		sync.DriftCompareSizeMtime,
+		"how to detect local changes, either size-mtime or sha256",
+	)
+	pullCmd.PersistentFlags().StringVarP(
+		&FlagDriftAction,
+		"drift-action",
+		"",
+		sync.DriftActionReport,
+		"what to do with locally changed files, either report or restore",
+	)
 	pullCmd.PersistentFlags().StringVarP(
 		&FlagDefaultFileMode, "default-file-mode", "m", "0664", "default mode to use for creating local file")
 	pullCmd.PersistentFlags().StringVarP(
-		&FlagS3Endpoint, "s3-endpoint", "", "", "override endpoint to use for remote object store (e.g. minio)")
+		&FlagDirMode, "dir-mode", "", "0777", "mode to use for creating local directories")
+	pullCmd.PersistentFlags().BoolVarP(
+		&FlagPreservePerms,
+		"preserve-perms",
+		"",
+		false,
+		"set mode, owner and group of local files from x-amz-meta-mode, x-amz-meta-uid and x-amz-meta-gid metadata",
+	)
+	pullCmd.PersistentFlags().BoolVarP(
+		&FlagPreserveMtime,
+		"preserve-mtime",
+		"",
+		false,
+		"set mtime of local files from x-amz-meta-mtime metadata or last modified time of remote objects",
+	)
+	pullCmd.PersistentFlags().BoolVarP(
+		&FlagVerify,
+		"verify",
+		"",
+		false,
+		"verify downloaded content against MD5 ETag and S3 additional checksums (CRC32C, SHA256)",
+	)
 	pullCmd.PersistentFlags().DurationVarP(
-		&FlagPullInterval, "interval", "i", time.Second * 5, "Interval between remote storage pulls")
+		&FlagPullInterval, "interval", "i", time.Second*5, "Interval between remote storage pulls")
+	pullCmd.PersistentFlags().DurationVarP(
+		&FlagMaxCycleTime,
+		"max-cycle-duration",
+		"",
+		time.Hour,
+		"fail /livez when a pull runs longer than given duration, 0 disables the check",
+	)
+	pullCmd.PersistentFlags().DurationVarP(
+		&FlagMaxStaleness,
+		"max-staleness",
+		"",
+		0,
+		"fail /readyz when the last successful pull is older than given duration, 0 disables the check",
+	)
+
+	var rollbackCmd = &cobra.Command{
+		Use:   "rollback LOCAL_PATH [CYCLE_ID]",
+		Args:  cobra.RangeArgs(1, 2),
+		Short: "Undo changes made to local directory by the last pull, or by all pulls since given cycle",
+		Run: func(cmd *cobra.Command, args []string) {
+			localDir := args[0]
+			if FlagHistoryDir == "" {
+				log.Fatal("--history-dir is required")
+			}
+
+			if FlagRollbackList {
+				cycles, err := sync.ListHistory(FlagHistoryDir)
+				if err != nil {
+					log.Fatal(err)
+				}
+				for _, cycle := range cycles {
+					fmt.Printf("%s\tcreated: %d\treplaced: %d\tdeleted: %d\n",
+						cycle.Id, len(cycle.Created), len(cycle.Replaced), len(cycle.Deleted))
+				}
+				return
+			}
+
+			cycleId := ""
+			if len(args) > 1 {
+				cycleId = args[1]
+			}
+			rolledBack, err := sync.Rollback(localDir, FlagHistoryDir, cycleId)
+			for _, id := range rolledBack {
+				fmt.Println("Rolled back cycle", id)
+			}
+			if err != nil {
+				log.Fatal(err)
+			}
+		},
+	}
+	rollbackCmd.PersistentFlags().StringVarP(
+		&FlagHistoryDir, "history-dir", "", "", "history directory used by pull")
+	rollbackCmd.PersistentFlags().BoolVarP(
+		&FlagRollbackList, "list", "l", false, "list cycles available for rollback instead")
+
+	var diffCmd = &cobra.Command{
+		Use:   "diff REMOTE_URI LOCAL_PATH",
+		Args:  cobra.ExactArgs(2),
+		Short: "Show changes a pull would make to local directory, exit with 1 if there are any",
+		Run: func(cmd *cobra.Command, args []string) {
+			puller := newPuller(cmd, args[0], args[1])
+			entries, err := puller.Diff()
+			if err != nil {
+				fmt.Println("ERROR: failed to compare remote with local directory:", err)
+				os.Exit(2)
+			}
+
+			printDiffEntries(entries)
+			if !sync.IsInSync(entries) {
+				os.Exit(1)
+			}
+		},
+	}
+	addPullerFlags(diffCmd)
+	diffCmd.PersistentFlags().BoolVarP(
+		&FlagJSON, "json", "", false, "print differences as JSON array")
+
+	var verifyCmd = &cobra.Command{
+		Use:   "verify REMOTE_URI LOCAL_PATH",
+		Args:  cobra.ExactArgs(2),
+		Short: "Check that local directory is an exact mirror of remote, exit with 1 if it's not",
+		Run: func(cmd *cobra.Command, args []string) {
+			puller := newPuller(cmd, args[0], args[1])
+			mismatches, err := puller.VerifyMirror(FlagVerifyStrict)
+			if err != nil {
+				fmt.Println("ERROR: failed to verify local directory:", err)
+				os.Exit(2)
+			}
+			if len(mismatches) == 0 && !FlagJSON {
+				fmt.Printf("%s matches %s\n", args[1], args[0])
+				return
+			}
+			printDiffEntries(mismatches)
+			if len(mismatches) > 0 {
+				os.Exit(1)
+			}
+		},
+	}
+	addPullerFlags(verifyCmd)
+	verifyCmd.PersistentFlags().BoolVarP(
+		&FlagVerifyStrict, "strict", "", false, "fail on local files not present remotely as well")
+	verifyCmd.PersistentFlags().BoolVarP(
+		&FlagJSON, "json", "", false, "print mismatches as JSON array")
+
+	var lsCmd = &cobra.Command{
+		Use:   "ls REMOTE_URI",
+		Args:  cobra.ExactArgs(1),
+		Short: "List remote objects and whether pull would include them",
+		Run: func(cmd *cobra.Command, args []string) {
+			// nothing is written locally, working dir is only needed to
+			// create a puller
+			puller := newPuller(cmd, args[0], ".")
+			entries, err := puller.List()
+			if err != nil {
+				log.Fatal(err)
+			}
+
+			if FlagJSON {
+				printJSON(entries)
+				return
+			}
+			for _, entry := range entries {
+				if entry.Included {
+					fmt.Printf("included\t%s\tsize: %d\tetag: %s\n", entry.Path, entry.Size, entry.ETag)
+				} else {
+					fmt.Printf("excluded\t%s\tsize: %d\tetag: %s\treason: %s\n",
+						entry.Path, entry.Size, entry.ETag, entry.Reason)
+				}
+			}
+		},
+	}
+	addPullerFlags(lsCmd)
+	lsCmd.PersistentFlags().BoolVarP(
+		&FlagJSON, "json", "", false, "print objects as JSON array")
 
 	rootCmd.AddCommand(pullCmd)
+	rootCmd.AddCommand(rollbackCmd)
+	rootCmd.AddCommand(diffCmd)
+	rootCmd.AddCommand(verifyCmd)
+	rootCmd.AddCommand(lsCmd)
 	rootCmd.Execute()
 }
@@ -0,0 +1,80 @@
+package sync
+
+import (
+	"path"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+)
+
+var metricsWaitingForCommit = prometheus.NewGauge(prometheus.GaugeOpts{
+	Namespace: "objinsync",
+	Subsystem: "pull",
+	Name:      "waiting_for_commit",
+	Help:      "Set to 1 when the last pull cycle was skipped because commit marker hasn't changed.",
+})
+
+func init() {
+	prometheus.MustRegister(metricsWaitingForCommit)
+}
+
+type GenericObjectHeader interface {
+	HeadObject(*s3.HeadObjectInput) (*s3.HeadObjectOutput, error)
+}
+
+// checkCommitMarker fetches metadata of CommitMarker object from the remote
+// prefix and reports whether it has changed since the last applied pull
+// together with its commit id. Pulls are not ready until the marker exists.
+func (self *Puller) checkCommitMarker(svc GenericObjectHeader, bucket string, remoteDirPath string) (string, bool, error) {
+	l := zap.S()
+
+	key := path.Join(remoteDirPath, self.CommitMarker)
+	input := &s3.HeadObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	}
+	self.setSSECustomerKeyOnHead(input)
+	head, err := svc.HeadObject(input)
+	if err != nil {
+		if isNotFoundErr(err) {
+			l.Infof("Waiting for commit, marker s3://%s/%s doesn't exist", bucket, key)
+			return "", false, nil
+		}
+		return "", false, err
+	}
+
+	id := commitId(head)
+	if id == self.appliedCommit {
+		l.Infof("Waiting for commit, marker s3://%s/%s hasn't changed", bucket, key)
+		return id, false, nil
+	}
+
+	// objects modified after the marker belong to the next commit
+	self.commitTime = aws.TimeValue(head.LastModified)
+	return id, true, nil
+}
+
+// commitId identifies a commit by ETag, last modified time and version id of
+// the marker. Markers like _SUCCESS are usually empty, so ETag alone is the
+// same for every commit.
+func commitId(head *s3.HeadObjectOutput) string {
+	lastModified := ""
+	if head.LastModified != nil {
+		lastModified = head.LastModified.UTC().Format(time.RFC3339Nano)
+	}
+	return strings.Join([]string{
+		aws.StringValue(head.ETag),
+		lastModified,
+		aws.StringValue(head.VersionId),
+	}, " ")
+}
+
+// isCommitMarker reports whether given path relative to the remote prefix is
+// the commit marker.
+func (self *Puller) isCommitMarker(relPath string) bool {
+	return self.CommitMarker != "" && relPath == path.Clean(self.CommitMarker)
+}
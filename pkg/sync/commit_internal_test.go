@@ -0,0 +1,128 @@
+package sync
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/stretchr/testify/assert"
+)
+
+type MockObjectHeader struct {
+	head *s3.HeadObjectOutput
+	key  string
+}
+
+func (self *MockObjectHeader) HeadObject(input *s3.HeadObjectInput) (*s3.HeadObjectOutput, error) {
+	self.key = *input.Key
+	if self.head == nil {
+		return nil, awserr.New("NotFound", "not found", nil)
+	}
+	return self.head, nil
+}
+
+func TestCheckCommitMarker(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	assert.Equal(t, nil, err)
+	defer os.RemoveAll(dir)
+
+	p, err := NewPuller("s3://foo/home", dir)
+	assert.Equal(t, nil, err)
+	p.CommitMarker = "_SUCCESS"
+
+	header := &MockObjectHeader{}
+	_, ready, err := p.checkCommitMarker(header, "foo", "home")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, false, ready)
+	assert.Equal(t, "home/_SUCCESS", header.key)
+
+	committed := time.Date(2023, 1, 2, 3, 4, 5, 0, time.UTC)
+	header.head = &s3.HeadObjectOutput{ETag: aws.String("\"1\""), LastModified: aws.Time(committed)}
+	id, ready, err := p.checkCommitMarker(header, "foo", "home")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, true, ready)
+	assert.Equal(t, "\"1\" 2023-01-02T03:04:05Z ", id)
+	assert.Equal(t, committed, p.commitTime)
+
+	// marker applied by the last pull
+	p.appliedCommit = id
+	_, ready, err = p.checkCommitMarker(header, "foo", "home")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, false, ready)
+
+	header.head = &s3.HeadObjectOutput{ETag: aws.String("\"2\""), LastModified: aws.Time(committed)}
+	id, ready, err = p.checkCommitMarker(header, "foo", "home")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, true, ready)
+	p.appliedCommit = id
+
+	// empty marker uploaded again has the same ETag
+	recommitted := committed.Add(time.Minute)
+	header.head = &s3.HeadObjectOutput{ETag: aws.String("\"2\""), LastModified: aws.Time(recommitted)}
+	id, ready, err = p.checkCommitMarker(header, "foo", "home")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, true, ready)
+	assert.Equal(t, recommitted, p.commitTime)
+	p.appliedCommit = id
+
+	// new version of the marker in a versioned bucket
+	header.head = &s3.HeadObjectOutput{
+		ETag: aws.String("\"2\""), LastModified: aws.Time(recommitted), VersionId: aws.String("v2")}
+	_, ready, err = p.checkCommitMarker(header, "foo", "home")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, true, ready)
+}
+
+func TestObjectsAfterCommitMarker(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	assert.Equal(t, nil, err)
+	defer os.RemoveAll(dir)
+
+	p, err := NewPuller("s3://foo/home", dir)
+	assert.Equal(t, nil, err)
+	p.CommitMarker = "_SUCCESS"
+	p.commitTime = time.Date(2023, 1, 2, 3, 4, 5, 0, time.UTC)
+	p.filesToDelete = map[string]bool{filepath.Join(dir, "b.py"): true}
+
+	p.taskQueue = make(chan DownloadTask, 10)
+	p.handlePageList(
+		&s3.ListObjectsV2Output{
+			Contents: []*s3.Object{
+				&s3.Object{
+					Key:          aws.String("home/_SUCCESS"),
+					ETag:         aws.String("1"),
+					LastModified: aws.Time(p.commitTime),
+				},
+				&s3.Object{
+					Key:          aws.String("home/a.py"),
+					ETag:         aws.String("2"),
+					LastModified: aws.Time(p.commitTime),
+				},
+				&s3.Object{
+					Key:          aws.String("home/b.py"),
+					ETag:         aws.String("3"),
+					LastModified: aws.Time(p.commitTime.Add(time.Second)),
+				},
+			},
+		},
+		false,
+		"foo",
+		"home",
+		dir,
+	)
+	close(p.taskQueue)
+
+	uris := []string{}
+	for task := range p.taskQueue {
+		uris = append(uris, task.Uri)
+	}
+	assert.Equal(t, []string{"s3://foo/home/a.py"}, uris)
+	// local copy of an object from the next commit is kept
+	assert.Equal(t, map[string]bool{}, p.filesToDelete)
+	assert.Equal(t, 1, p.fileSkippedCnt)
+}
@@ -0,0 +1,92 @@
+package sync
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/s3"
+	"go.uber.org/zap"
+)
+
+const (
+	// compare MD5 of local files with object ETags
+	CompareETag = "etag"
+	// compare SHA-256 of local files with S3 ChecksumSHA256 of objects, which
+	// works for objects whose ETag is not MD5 of content, e.g. SSE-KMS
+	CompareSHA256 = "sha256"
+	// compare size and mtime of local files with size and last modified time
+	// of objects, which only requires stat calls on startup
+	CompareSizeMtime = "size-mtime"
+)
+
+// SetCompareMode sets the strategy used to detect whether local files are up
+// to date with remote objects.
+func (self *Puller) SetCompareMode(mode string) error {
+	switch mode {
+	case CompareETag, CompareSHA256, CompareSizeMtime:
+	default:
+		return fmt.Errorf("unsupported compare mode: %s", mode)
+	}
+	self.compare = mode
+	return nil
+}
+
+// sizeMtimeUid builds uid for size-mtime compare mode. Mtime is compared in
+// seconds since S3 last modified time doesn't have sub-second precision.
+func sizeMtimeUid(size int64, mtime time.Time) string {
+	return fmt.Sprintf("%d:%d", size, mtime.Unix())
+}
+
+// remoteUid returns uid of an object for comparison with uid cache.
+func (self *Puller) remoteUid(obj *s3.Object) string {
+	if self.compare == CompareSizeMtime && obj.Size != nil && obj.LastModified != nil {
+		return sizeMtimeUid(*obj.Size, *obj.LastModified)
+	}
+	return *(obj.ETag)
+}
+
+// sha256FromLocalPath returns base64 encoded SHA-256 digest of given file, in
+// the same format as S3 ChecksumSHA256.
+func sha256FromLocalPath(localPath string) (string, error) {
+	f, err := os.Open(localPath)
+	if err != nil {
+		return "", fmt.Errorf("Invalid file path for checksum calculation: %s, err: %s", localPath, err)
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", fmt.Errorf("Failed to calculate checksum for file: %s, err: %s", localPath, err)
+	}
+	return base64.StdEncoding.EncodeToString(h.Sum(nil)), nil
+}
+
+// isLocalContentUpToDate checks local checksum calculated during startup
+// against checksum from object metadata. It's used in sha256 compare mode to
+// avoid downloading objects that are already present locally.
+func (self *Puller) isLocalContentUpToDate(task DownloadTask, head *s3.HeadObjectOutput) bool {
+	if self.compare != CompareSHA256 || head == nil {
+		return false
+	}
+
+	self.uidLock.Lock()
+	localSum, ok := self.localSums[task.UidKey]
+	// local checksum is only useful for the first comparison, uid cache
+	// takes over from here
+	delete(self.localSums, task.UidKey)
+	self.uidLock.Unlock()
+	if !ok {
+		return false
+	}
+
+	remoteSum := fullObjectChecksum(head.ChecksumSHA256)
+	if remoteSum == "" {
+		zap.S().Debugf("No SHA-256 checksum available for %s", task.Uri)
+		return false
+	}
+	return remoteSum == localSum
+}
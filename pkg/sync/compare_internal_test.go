@@ -0,0 +1,159 @@
+package sync
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSetCompareMode(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	assert.Equal(t, nil, err)
+	defer os.RemoveAll(dir)
+
+	p, err := NewPuller("s3://abc/efg", dir)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, CompareETag, p.compare)
+	assert.Equal(t, nil, p.SetCompareMode(CompareSHA256))
+	assert.NotEqual(t, nil, p.SetCompareMode("crc64"))
+	assert.Equal(t, CompareSHA256, p.compare)
+}
+
+func TestSha256CompareMode(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	assert.Equal(t, nil, err)
+	defer os.RemoveAll(dir)
+
+	content := "print('hello')"
+	sum := sha256.Sum256([]byte(content))
+	checksum := base64.StdEncoding.EncodeToString(sum[:])
+	for _, name := range []string{"same.py", "changed.py"} {
+		err = ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644)
+		assert.Equal(t, nil, err)
+	}
+
+	p, err := NewPuller("s3://abc/efg", dir)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, nil, p.SetCompareMode(CompareSHA256))
+	p.PopulateChecksum()
+	assert.Equal(t, map[string]string{"same.py": checksum, "changed.py": checksum}, p.localSums)
+	assert.Equal(t, 0, len(p.uidCache))
+
+	p.errMsgQueue = make(chan string, 30)
+	assert.Equal(t, nil, p.SetupWorkingDir())
+	p.downloadHandler(
+		DownloadTask{
+			Uri:       "s3://abc/efg/same.py",
+			LocalPath: filepath.Join(dir, "same.py"),
+			Uid:       "\"kms-etag-1\"",
+			UidKey:    "same.py",
+		},
+		MockDownloader{content: "should not be downloaded", sha256: checksum})
+	p.downloadHandler(
+		DownloadTask{
+			Uri:       "s3://abc/efg/changed.py",
+			LocalPath: filepath.Join(dir, "changed.py"),
+			Uid:       "\"kms-etag-2\"",
+			UidKey:    "changed.py",
+		},
+		MockDownloader{content: "print('world')", sha256: "changed"})
+	close(p.errMsgQueue)
+	for msg := range p.errMsgQueue {
+		assert.Fail(t, msg)
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, "same.py"))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, content, string(data))
+	data, err = ioutil.ReadFile(filepath.Join(dir, "changed.py"))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "print('world')", string(data))
+
+	assert.Equal(t, map[string]string{"same.py": "\"kms-etag-1\"", "changed.py": "\"kms-etag-2\""}, p.uidCache)
+	assert.Equal(t, 0, len(p.localSums))
+}
+
+func TestSizeMtimeCompareMode(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	assert.Equal(t, nil, err)
+	defer os.RemoveAll(dir)
+
+	lastModified := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	for _, name := range []string{"same.py", "touched.py"} {
+		path := filepath.Join(dir, name)
+		err = ioutil.WriteFile(path, []byte("test"), 0644)
+		assert.Equal(t, nil, err)
+		assert.Equal(t, nil, os.Chtimes(path, lastModified, lastModified))
+	}
+
+	p, err := NewPuller("s3://foo/home", dir)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, nil, p.SetCompareMode(CompareSizeMtime))
+	p.PopulateChecksum()
+	assert.Equal(t, map[string]string{
+		"same.py":    sizeMtimeUid(4, lastModified),
+		"touched.py": sizeMtimeUid(4, lastModified),
+	}, p.uidCache)
+
+	p.taskQueue = make(chan DownloadTask, 10)
+	var tasks []DownloadTask
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		for task := range p.taskQueue {
+			tasks = append(tasks, task)
+		}
+		wg.Done()
+	}()
+	p.handlePageList(
+		&s3.ListObjectsV2Output{
+			Contents: []*s3.Object{
+				&s3.Object{
+					Key:          aws.String("home/same.py"),
+					ETag:         aws.String("\"1\""),
+					Size:         aws.Int64(4),
+					LastModified: aws.Time(lastModified),
+				},
+				&s3.Object{
+					Key:          aws.String("home/touched.py"),
+					ETag:         aws.String("\"2\""),
+					Size:         aws.Int64(4),
+					LastModified: aws.Time(lastModified.Add(time.Hour)),
+				},
+			},
+		},
+		false,
+		"foo",
+		"home",
+		dir,
+	)
+	close(p.taskQueue)
+	wg.Wait()
+
+	assert.Equal(t, 1, len(tasks))
+	assert.Equal(t, "touched.py", tasks[0].UidKey)
+	assert.Equal(t, sizeMtimeUid(4, lastModified.Add(time.Hour)), tasks[0].Uid)
+
+	// downloaded file is stamped with last modified time so it matches on
+	// next startup
+	p.errMsgQueue = make(chan string, 30)
+	assert.Equal(t, nil, p.SetupWorkingDir())
+	p.downloadHandler(tasks[0], MockDownloader{content: "test"})
+	close(p.errMsgQueue)
+	for msg := range p.errMsgQueue {
+		assert.Fail(t, msg)
+	}
+
+	fi, err := os.Stat(filepath.Join(dir, "touched.py"))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, tasks[0].Uid, sizeMtimeUid(fi.Size(), fi.ModTime()))
+}
@@ -0,0 +1,158 @@
+package sync
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+const (
+	// user metadata describing envelope encrypted objects:
+	//
+	// x-amz-meta-objinsync-cipher: AES-256-GCM
+	// x-amz-meta-objinsync-key-id: id of the key used to wrap data key
+	// x-amz-meta-objinsync-wrapped-key: base64 of nonce followed by data key
+	//   sealed with the wrapping key using AES-256-GCM
+	//
+	// Object content is a nonce followed by the plaintext sealed with the data
+	// key using AES-256-GCM.
+	metaKeyCipher     = "objinsync-cipher"
+	metaKeyKeyId      = "objinsync-key-id"
+	metaKeyWrappedKey = "objinsync-wrapped-key"
+
+	envelopeCipher = "AES-256-GCM"
+)
+
+// KeyProvider unwraps data keys of envelope encrypted objects.
+type KeyProvider interface {
+	UnwrapKey(keyId string, wrapped []byte) ([]byte, error)
+}
+
+// LocalKeyFileProvider unwraps data keys with AES-256 keys loaded from a local
+// file.
+type LocalKeyFileProvider struct {
+	keys map[string][]byte
+}
+
+// NewLocalKeyFileProvider loads wrapping keys from given file. Each line
+// contains a key id followed by base64 encoded 256 bit key, separated by
+// whitespace. A line with only the key defines the key with empty id.
+func NewLocalKeyFileProvider(path string) (*LocalKeyFileProvider, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read key file %s: %v", path, err)
+	}
+
+	provider := &LocalKeyFileProvider{keys: map[string][]byte{}}
+	scanner := bufio.NewScanner(strings.NewReader(string(content)))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+
+		keyId := ""
+		encoded := fields[0]
+		if len(fields) == 2 {
+			keyId = fields[0]
+			encoded = fields[1]
+		} else if len(fields) > 2 {
+			return nil, fmt.Errorf("invalid line in key file %s", path)
+		}
+
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil || len(key) != 32 {
+			return nil, fmt.Errorf("key %q in %s is not a base64 encoded 256 bit key", keyId, path)
+		}
+		provider.keys[keyId] = key
+	}
+	if len(provider.keys) == 0 {
+		return nil, fmt.Errorf("no key found in key file %s", path)
+	}
+
+	return provider, nil
+}
+
+func (self *LocalKeyFileProvider) UnwrapKey(keyId string, wrapped []byte) ([]byte, error) {
+	key, ok := self.keys[keyId]
+	if !ok {
+		return nil, fmt.Errorf("key %q not found", keyId)
+	}
+	return openAESGCM(key, wrapped)
+}
+
+// openAESGCM decrypts data consisting of a nonce followed by sealed content.
+func openAESGCM(key []byte, data []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < gcm.NonceSize() {
+		return nil, fmt.Errorf("encrypted content is too short")
+	}
+	nonce := data[:gcm.NonceSize()]
+	return gcm.Open(nil, nonce, data[gcm.NonceSize():], nil)
+}
+
+// isEnvelopeEncrypted reports whether object metadata marks the object as
+// envelope encrypted.
+func isEnvelopeEncrypted(meta map[string]*string) bool {
+	_, ok := objectMetadata(meta, metaKeyCipher)
+	return ok
+}
+
+// decryptFile replaces content of given file with content decrypted using
+// data key from object metadata.
+func decryptFile(path string, meta map[string]*string, provider KeyProvider) error {
+	cipherName, _ := objectMetadata(meta, metaKeyCipher)
+	if cipherName != envelopeCipher {
+		return fmt.Errorf("unsupported cipher: %s", cipherName)
+	}
+	keyId, _ := objectMetadata(meta, metaKeyKeyId)
+	encodedKey, ok := objectMetadata(meta, metaKeyWrappedKey)
+	if !ok {
+		return fmt.Errorf("missing wrapped data key")
+	}
+	wrappedKey, err := base64.StdEncoding.DecodeString(encodedKey)
+	if err != nil {
+		return fmt.Errorf("invalid wrapped data key: %v", err)
+	}
+
+	dataKey, err := provider.UnwrapKey(keyId, wrappedKey)
+	if err != nil {
+		return fmt.Errorf("failed to unwrap data key: %v", err)
+	}
+
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	plaintext, err := openAESGCM(dataKey, content)
+	if err != nil {
+		return fmt.Errorf("failed to decrypt content: %v", err)
+	}
+
+	// truncate instead of recreating the file to keep its mode
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_TRUNC, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.Write(plaintext)
+	return err
+}
+
+// SetKeyProvider enables client side decryption of envelope encrypted objects
+// with data keys unwrapped by given provider.
+func (self *Puller) SetKeyProvider(provider KeyProvider) {
+	self.keyProvider = provider
+}
@@ -0,0 +1,154 @@
+package sync
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/stretchr/testify/assert"
+)
+
+func sealAESGCM(t *testing.T, key []byte, plaintext []byte) []byte {
+	block, err := aes.NewCipher(key)
+	assert.Equal(t, nil, err)
+	gcm, err := cipher.NewGCM(block)
+	assert.Equal(t, nil, err)
+	nonce := bytes.Repeat([]byte("n"), gcm.NonceSize())
+	return gcm.Seal(nonce, nonce, plaintext, nil)
+}
+
+// encryptEnvelope returns object content and metadata for plaintext
+// encrypted with a data key wrapped by given wrapping key.
+func encryptEnvelope(t *testing.T, keyId string, wrappingKey []byte, plaintext string) (string, map[string]*string) {
+	dataKey := bytes.Repeat([]byte("d"), 32)
+	wrapped := sealAESGCM(t, wrappingKey, dataKey)
+	meta := map[string]*string{
+		"Objinsync-Cipher":      aws.String(envelopeCipher),
+		"Objinsync-Key-Id":      aws.String(keyId),
+		"Objinsync-Wrapped-Key": aws.String(base64.StdEncoding.EncodeToString(wrapped)),
+	}
+	return string(sealAESGCM(t, dataKey, []byte(plaintext))), meta
+}
+
+func writeKeyFile(t *testing.T, dir string, content string) string {
+	path := filepath.Join(dir, "keys")
+	assert.Equal(t, nil, ioutil.WriteFile(path, []byte(content), 0600))
+	return path
+}
+
+func TestLocalKeyFileProvider(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	assert.Equal(t, nil, err)
+	defer os.RemoveAll(dir)
+
+	key := bytes.Repeat([]byte("w"), 32)
+	encoded := base64.StdEncoding.EncodeToString(key)
+
+	provider, err := NewLocalKeyFileProvider(
+		writeKeyFile(t, dir, "# comment\n\nprod "+encoded+"\n"+encoded+"\n"))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, key, provider.keys["prod"])
+	assert.Equal(t, key, provider.keys[""])
+
+	_, err = NewLocalKeyFileProvider(writeKeyFile(t, dir, "prod c2hvcnQ=\n"))
+	assert.NotEqual(t, nil, err)
+
+	_, err = NewLocalKeyFileProvider(writeKeyFile(t, dir, "# no keys\n"))
+	assert.NotEqual(t, nil, err)
+
+	_, err = NewLocalKeyFileProvider(filepath.Join(dir, "missing"))
+	assert.NotEqual(t, nil, err)
+}
+
+func TestDecryptFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	assert.Equal(t, nil, err)
+	defer os.RemoveAll(dir)
+
+	key := bytes.Repeat([]byte("w"), 32)
+	provider := &LocalKeyFileProvider{keys: map[string][]byte{"prod": key}}
+	content, meta := encryptEnvelope(t, "prod", key, "print('hello')")
+
+	path := filepath.Join(dir, "a.py")
+	assert.Equal(t, nil, ioutil.WriteFile(path, []byte(content), 0640))
+	assert.Equal(t, true, isEnvelopeEncrypted(meta))
+	assert.Equal(t, nil, decryptFile(path, meta, provider))
+
+	decrypted, err := ioutil.ReadFile(path)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "print('hello')", string(decrypted))
+	fi, err := os.Stat(path)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, os.FileMode(0640), fi.Mode().Perm())
+
+	// unknown key id
+	assert.Equal(t, nil, ioutil.WriteFile(path, []byte(content), 0640))
+	meta["Objinsync-Key-Id"] = aws.String("dev")
+	assert.NotEqual(t, nil, decryptFile(path, meta, provider))
+
+	// tampered content
+	meta["Objinsync-Key-Id"] = aws.String("prod")
+	tampered := []byte(content)
+	tampered[len(tampered)-1] ^= 1
+	assert.Equal(t, nil, ioutil.WriteFile(path, tampered, 0640))
+	assert.NotEqual(t, nil, decryptFile(path, meta, provider))
+
+	assert.Equal(t, false, isEnvelopeEncrypted(map[string]*string{}))
+}
+
+func TestDownloadWithDecryption(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	assert.Equal(t, nil, err)
+	defer os.RemoveAll(dir)
+
+	key := bytes.Repeat([]byte("w"), 32)
+	content, meta := encryptEnvelope(t, "prod", key, "print('hello')")
+
+	p, err := NewPuller("s3://abc/efg", dir)
+	assert.Equal(t, nil, err)
+	p.SetKeyProvider(&LocalKeyFileProvider{keys: map[string][]byte{"prod": key}})
+	p.errMsgQueue = make(chan string, 30)
+	assert.Equal(t, nil, p.SetupWorkingDir())
+
+	p.downloadHandler(
+		DownloadTask{
+			Uri:       "s3://abc/efg/a.py",
+			LocalPath: filepath.Join(dir, "a.py"),
+			Uid:       "uid",
+			UidKey:    "a.py",
+		},
+		MockDownloader{content: content, metadata: meta})
+
+	// wrong key leaves existing local file untouched
+	p.SetKeyProvider(&LocalKeyFileProvider{keys: map[string][]byte{"prod": bytes.Repeat([]byte("x"), 32)}})
+	p.downloadHandler(
+		DownloadTask{
+			Uri:       "s3://abc/efg/a.py",
+			LocalPath: filepath.Join(dir, "a.py"),
+			Uid:       "uid2",
+			UidKey:    "a.py",
+		},
+		MockDownloader{content: content, metadata: meta})
+	close(p.errMsgQueue)
+
+	messages := []string{}
+	for msg := range p.errMsgQueue {
+		messages = append(messages, msg)
+	}
+	assert.Equal(t, 1, len(messages))
+
+	decrypted, err := ioutil.ReadFile(filepath.Join(dir, "a.py"))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "print('hello')", string(decrypted))
+	assert.Equal(t, "uid", p.uidCache["a.py"])
+
+	files, err := ioutil.ReadDir(p.workingDir)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 0, len(files))
+}
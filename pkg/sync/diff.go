@@ -0,0 +1,275 @@
+package sync
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+const (
+	// object doesn't exist locally
+	DiffAdded = "added"
+	// local file differs from object
+	DiffModified = "modified"
+	// local file doesn't exist remotely
+	DiffDeleted = "deleted"
+	// object is skipped by exclude patterns, filters or manifest
+	DiffExcluded = "excluded"
+)
+
+// DiffEntry is a difference between the remote prefix and local dir that a
+// pull would act on, or an object a pull would skip.
+type DiffEntry struct {
+	Path   string `json:"path"`
+	Status string `json:"status"`
+	// size of the object, or of the local file for deleted entries
+	Size int64 `json:"size"`
+	// ETag of the object, size and mtime in size-mtime compare mode or
+	// base64 encoded SHA-256 in sha256 compare mode
+	RemoteId string `json:"remote_id,omitempty"`
+	// id of the local file in the same format as RemoteId
+	LocalId string `json:"local_id,omitempty"`
+	// why an object is excluded
+	Reason string `json:"reason,omitempty"`
+}
+
+// Diff compares the remote prefix with local dir using the same rules as
+// Pull without changing anything locally. Entries are sorted by path.
+func (self *Puller) Diff() ([]DiffEntry, error) {
+	svc, list, err := self.prepareListing()
+	if err != nil {
+		return nil, err
+	}
+	return self.diff(list, &s3Downloader{svc: svc})
+}
+
+// prepareListing loads remote ignore rules and manifest the same way as Pull,
+// and returns a function feeding remote objects into handlePageList.
+func (self *Puller) prepareListing() (*s3.S3, func() error, error) {
+	bucket, remoteDirPath, err := parseObjectUri(self.RemoteUri)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid remote uri %s: %v", self.RemoteUri, err)
+	}
+
+	svc, err := self.newS3Client()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if self.RemoteIgnore {
+		if err := self.loadRemoteIgnore(svc, bucket, remoteDirPath); err != nil {
+			return nil, nil, fmt.Errorf("failed to load remote ignore file: %v", err)
+		}
+	}
+	if self.manifestKey != nil || self.ManifestSync {
+		if err := self.loadManifest(svc, bucket, remoteDirPath); err != nil {
+			return nil, nil, fmt.Errorf("failed to load manifest: %v", err)
+		}
+	}
+
+	list := func() error {
+		return self.listRemote(svc, bucket, remoteDirPath)
+	}
+	return svc, list, nil
+}
+
+// collectTasks runs list with onObject set and returns download tasks it
+// produced instead of downloading them.
+func (self *Puller) collectTasks(
+	list func() error,
+	onObject func(relPath string, obj *s3.Object, skipReason string),
+) ([]DownloadTask, error) {
+	self.onObject = onObject
+	defer func() {
+		self.onObject = nil
+	}()
+
+	var tasks []DownloadTask
+	self.taskQueue = make(chan DownloadTask, 30)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		for task := range self.taskQueue {
+			tasks = append(tasks, task)
+		}
+		wg.Done()
+	}()
+	err := list()
+	close(self.taskQueue)
+	wg.Wait()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list remote uri %s: %v", self.RemoteUri, err)
+	}
+	return tasks, nil
+}
+
+// diff collects download tasks and skipped objects produced by list through
+// handlePageList, and local files left in the delete list.
+func (self *Puller) diff(list func() error, downloader GenericDownloader) ([]DiffEntry, error) {
+	// local files are assumed to be unknown, uids are calculated the same
+	// way as on pull startup
+	self.PopulateChecksum()
+
+	filesToDelete, err := listAndPruneDir(self.LocalDir, self.matcher, false)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list local dir %s: %v", self.LocalDir, err)
+	}
+	self.filesToDelete = filesToDelete
+	defer func() {
+		self.filesToDelete = nil
+	}()
+
+	entries := []DiffEntry{}
+	tasks, err := self.collectTasks(list, func(relPath string, obj *s3.Object, skipReason string) {
+		if skipReason == "" {
+			return
+		}
+		entry := DiffEntry{Path: relPath, Status: DiffExcluded, Reason: skipReason}
+		if obj.Size != nil {
+			entry.Size = *obj.Size
+		}
+		entry.RemoteId = self.remoteUid(obj)
+		entries = append(entries, entry)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, task := range tasks {
+		entry := DiffEntry{
+			Path:     task.UidKey,
+			Status:   DiffAdded,
+			Size:     task.Size,
+			RemoteId: task.Uid,
+			LocalId:  self.localId(task.UidKey),
+		}
+		if self.compare == CompareSHA256 {
+			head, err := self.headTask(task, downloader)
+			if err != nil {
+				return nil, fmt.Errorf("failed to fetch metadata for %s: %v", task.Uri, err)
+			}
+			if sum := fullObjectChecksum(head.ChecksumSHA256); sum != "" {
+				entry.RemoteId = sum
+			}
+			if self.isLocalContentUpToDate(task, head) {
+				continue
+			}
+		}
+		info, err := os.Lstat(task.LocalPath)
+		if err == nil {
+			entry.Status = DiffModified
+		}
+		if err == nil && info.Mode().IsRegular() && self.compare == CompareETag {
+			// ETag is not MD5 of content for multipart, SSE-KMS and SSE-C
+			// objects, compare with digests derived from object metadata
+			// instead
+			head, err := self.headTask(task, downloader)
+			if err != nil {
+				return nil, fmt.Errorf("failed to fetch metadata for %s: %v", task.Uri, err)
+			}
+			match, err := localMatchesDigests(task.LocalPath, head)
+			if err != nil {
+				return nil, err
+			}
+			if match {
+				continue
+			}
+			if digestsFromHead(head).empty() {
+				entry.Reason = "no content digest available for object"
+			}
+		}
+		entries = append(entries, entry)
+	}
+
+	for localPath := range self.filesToDelete {
+		uidKey, err := uidKeyFromLocalPath(self.LocalDir, localPath)
+		if err != nil {
+			return nil, err
+		}
+		entry := DiffEntry{Path: uidKey, Status: DiffDeleted, LocalId: self.localId(uidKey)}
+		if info, err := os.Lstat(localPath); err == nil {
+			entry.Size = info.Size()
+		}
+		entries = append(entries, entry)
+	}
+
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].Path < entries[j].Path })
+	return entries, nil
+}
+
+// headTask fetches metadata of the object version a task would download.
+func (self *Puller) headTask(task DownloadTask, downloader GenericDownloader) (*s3.HeadObjectOutput, error) {
+	bucket, key, err := parseObjectUri(task.Uri)
+	if err != nil {
+		return nil, err
+	}
+	input := &s3.HeadObjectInput{
+		Bucket:       aws.String(bucket),
+		Key:          aws.String(key),
+		ChecksumMode: aws.String(s3.ChecksumModeEnabled),
+	}
+	if task.VersionId != "" {
+		input.VersionId = aws.String(task.VersionId)
+	}
+	self.setSSECustomerKeyOnHead(input)
+	return downloader.HeadObject(input)
+}
+
+// localMatchesDigests compares content of a local file with digests derived
+// from object metadata, MD5 from ETag if it is one and S3 additional
+// checksums. False is returned if no digest is available.
+func localMatchesDigests(localPath string, head *s3.HeadObjectOutput) (bool, error) {
+	expected := digestsFromHead(head)
+	if expected.empty() {
+		return false, nil
+	}
+	hashes := newContentHashes()
+	if err := hashes.hashFile(localPath); err != nil {
+		return false, err
+	}
+	return hashes.verify(expected) == nil, nil
+}
+
+// localId returns uid of a local file calculated by PopulateChecksum.
+func (self *Puller) localId(uidKey string) string {
+	self.uidLock.Lock()
+	defer self.uidLock.Unlock()
+	if uid, ok := self.uidCache[uidKey]; ok {
+		return uid
+	}
+	return self.localSums[uidKey]
+}
+
+// IsInSync reports whether entries contain no changes a pull would make.
+func IsInSync(entries []DiffEntry) bool {
+	return len(mirrorMismatches(entries, true)) == 0
+}
+
+// VerifyMirror checks that local dir is an exact copy of the remote prefix by
+// comparing content hashes, and returns entries that don't match. Local files
+// not present remotely only count as mismatches in strict mode.
+func (self *Puller) VerifyMirror(strict bool) ([]DiffEntry, error) {
+	if self.compare == CompareSizeMtime {
+		return nil, fmt.Errorf("verify requires %s or %s compare mode", CompareETag, CompareSHA256)
+	}
+	entries, err := self.Diff()
+	if err != nil {
+		return nil, err
+	}
+	return mirrorMismatches(entries, strict), nil
+}
+
+func mirrorMismatches(entries []DiffEntry, strict bool) []DiffEntry {
+	mismatches := []DiffEntry{}
+	for _, entry := range entries {
+		if entry.Status == DiffExcluded || (entry.Status == DiffDeleted && !strict) {
+			continue
+		}
+		mismatches = append(mismatches, entry)
+	}
+	return mismatches
+}
@@ -0,0 +1,168 @@
+package sync
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDiff(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	assert.Equal(t, nil, err)
+	defer os.RemoveAll(dir)
+
+	for _, name := range []string{"same.py", "changed.py", "extra.py", "airflow.cfg"} {
+		assert.Equal(t, nil, ioutil.WriteFile(filepath.Join(dir, name), []byte("a"), 0644))
+	}
+	etag := fmt.Sprintf("\"%x\"", md5.Sum([]byte("a")))
+	changedETag := fmt.Sprintf("\"%x\"", md5.Sum([]byte("b")))
+
+	p, err := NewPuller("s3://foo/home", dir)
+	assert.Equal(t, nil, err)
+	p.AddExcludePatterns([]string{"airflow.cfg"})
+
+	list := func() error {
+		p.handlePageList(
+			&s3.ListObjectsV2Output{
+				Contents: []*s3.Object{
+					&s3.Object{Key: aws.String("home/same.py"), ETag: aws.String(etag), Size: aws.Int64(1)},
+					&s3.Object{Key: aws.String("home/changed.py"), ETag: aws.String(changedETag), Size: aws.Int64(2)},
+					&s3.Object{Key: aws.String("home/dags/new.py"), ETag: aws.String("\"3\""), Size: aws.Int64(3)},
+					&s3.Object{Key: aws.String("home/airflow.cfg"), ETag: aws.String("\"4\""), Size: aws.Int64(4)},
+				},
+			},
+			true,
+			"foo",
+			"home",
+			dir,
+		)
+		return nil
+	}
+	entries, err := p.diff(list, MockDownloader{etag: changedETag})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, []DiffEntry{
+		DiffEntry{Path: "airflow.cfg", Status: DiffExcluded, Size: 4, RemoteId: "\"4\"", Reason: "exclude pattern \"airflow.cfg\""},
+		DiffEntry{Path: "changed.py", Status: DiffModified, Size: 2, RemoteId: changedETag, LocalId: etag},
+		DiffEntry{Path: "dags/new.py", Status: DiffAdded, Size: 3, RemoteId: "\"3\""},
+		DiffEntry{Path: "extra.py", Status: DiffDeleted, Size: 1, LocalId: etag},
+	}, entries)
+	assert.Equal(t, false, IsInSync(entries))
+	assert.Equal(t, true, IsInSync(entries[:1]))
+
+	// nothing is written locally
+	_, err = os.Stat(filepath.Join(dir, "dags"))
+	assert.Equal(t, true, os.IsNotExist(err))
+	_, err = os.Stat(filepath.Join(dir, "extra.py"))
+	assert.Equal(t, nil, err)
+}
+
+func TestDiffMultipartObjects(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	assert.Equal(t, nil, err)
+	defer os.RemoveAll(dir)
+	assert.Equal(t, nil, ioutil.WriteFile(filepath.Join(dir, "big.bin"), []byte("a"), 0644))
+	sum := sha256.Sum256([]byte("a"))
+
+	p, err := NewPuller("s3://foo/home", dir)
+	assert.Equal(t, nil, err)
+	list := func() error {
+		p.handlePageList(
+			&s3.ListObjectsV2Output{
+				Contents: []*s3.Object{
+					&s3.Object{Key: aws.String("home/big.bin"), ETag: aws.String("\"abc-2\""), Size: aws.Int64(1)},
+				},
+			},
+			true,
+			"foo",
+			"home",
+			dir,
+		)
+		return nil
+	}
+
+	// local content is compared with additional checksums
+	entries, err := p.diff(list, MockDownloader{sha256: base64.StdEncoding.EncodeToString(sum[:])})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 0, len(entries))
+
+	entries, err = p.diff(list, MockDownloader{sha256: "changed"})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 1, len(entries))
+	assert.Equal(t, DiffModified, entries[0].Status)
+
+	// without checksums local content can't be verified
+	entries, err = p.diff(list, MockDownloader{})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 1, len(entries))
+}
+
+func TestMirrorMismatches(t *testing.T) {
+	entries := []DiffEntry{
+		DiffEntry{Path: "a", Status: DiffAdded},
+		DiffEntry{Path: "b", Status: DiffDeleted},
+		DiffEntry{Path: "c", Status: DiffExcluded},
+		DiffEntry{Path: "d", Status: DiffModified},
+	}
+	assert.Equal(t, []DiffEntry{entries[0], entries[3]}, mirrorMismatches(entries, false))
+	assert.Equal(t, []DiffEntry{entries[0], entries[1], entries[3]}, mirrorMismatches(entries, true))
+	assert.Equal(t, true, IsInSync(entries[2:3]))
+	assert.Equal(t, false, IsInSync(entries[1:3]))
+}
+
+type KMSDownloader struct {
+	MockDownloader
+}
+
+func (self KMSDownloader) HeadObject(input *s3.HeadObjectInput) (*s3.HeadObjectOutput, error) {
+	head, err := self.MockDownloader.HeadObject(input)
+	head.ServerSideEncryption = aws.String(s3.ServerSideEncryptionAwsKms)
+	return head, err
+}
+
+func TestDiffKMSEncryptedObjects(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	assert.Equal(t, nil, err)
+	defer os.RemoveAll(dir)
+	assert.Equal(t, nil, ioutil.WriteFile(filepath.Join(dir, "a.py"), []byte("a"), 0644))
+	sum := sha256.Sum256([]byte("a"))
+	// looks like MD5, but isn't MD5 of content for SSE-KMS objects
+	kmsETag := "\"0123456789abcdef0123456789abcdef\""
+
+	p, err := NewPuller("s3://foo/home", dir)
+	assert.Equal(t, nil, err)
+	list := func() error {
+		p.handlePageList(
+			&s3.ListObjectsV2Output{
+				Contents: []*s3.Object{
+					&s3.Object{Key: aws.String("home/a.py"), ETag: aws.String(kmsETag), Size: aws.Int64(1)},
+				},
+			},
+			true,
+			"foo",
+			"home",
+			dir,
+		)
+		return nil
+	}
+
+	entries, err := p.diff(list, KMSDownloader{MockDownloader{
+		etag: kmsETag, sha256: base64.StdEncoding.EncodeToString(sum[:])}})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 0, len(entries))
+
+	// content can't be compared without additional checksums
+	entries, err = p.diff(list, KMSDownloader{MockDownloader{etag: kmsETag}})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 1, len(entries))
+	assert.Equal(t, DiffModified, entries[0].Status)
+	assert.Equal(t, "no content digest available for object", entries[0].Reason)
+}
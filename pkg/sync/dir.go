@@ -4,16 +4,15 @@ import (
 	"os"
 	"path/filepath"
 
-	"github.com/bmatcuk/doublestar"
 	"go.uber.org/zap"
 )
 
 // This function finds all files in a given directory and return them in a map.
-// It also purges empty directories.
+// It also purges empty directories if prune is set.
 //
 // file map contains absolute path
 // it won't include directories in the returned map
-func listAndPruneDir(dirname string, exclude []string) (map[string]bool, error) {
+func listAndPruneDir(dirname string, matcher *pathMatcher, prune bool) (map[string]bool, error) {
 	l := zap.S()
 	files := make(map[string]bool)
 	dirsToDelete := make(map[string]bool)
@@ -34,13 +33,7 @@ func listAndPruneDir(dirname string, exclude []string) (map[string]bool, error)
 				// this is so that pattern `foo/**` also matches `foo`
 				relPath += "/"
 			}
-			for _, pattern := range exclude {
-				matched, _ := doublestar.Match(pattern, relPath)
-				if matched {
-					shouldSkip = true
-					break
-				}
-			}
+			shouldSkip = matcher.Match(relPath)
 		}
 
 		if info.IsDir() {
@@ -52,6 +45,8 @@ func listAndPruneDir(dirname string, exclude []string) (map[string]bool, error)
 				dirsToDelete[path] = true
 			}
 		} else {
+			// filepath.Walk doesn't follow symlinks, so symlinks to
+			// directories are tracked as files here as well
 			if shouldSkip {
 				return nil
 			}
@@ -68,6 +63,10 @@ func listAndPruneDir(dirname string, exclude []string) (map[string]bool, error)
 		return nil, err
 	}
 
+	if !prune {
+		return files, nil
+	}
+
 	// delete empty dirs
 	for d, _ := range dirsToDelete {
 		os.Remove(d)
@@ -27,7 +27,7 @@ func TestWalkAndDeleteEmptyDir(t *testing.T) {
 	err = ioutil.WriteFile(fileB, []byte("test2"), 0644)
 	assert.Equal(t, nil, err)
 
-	files, err := listAndPruneDir(dir, nil)
+	files, err := listAndPruneDir(dir, nil, true)
 	assert.Equal(t, nil, err)
 
 	for _, f := range []string{fileA, fileB} {
@@ -44,6 +44,26 @@ func TestWalkAndDeleteEmptyDir(t *testing.T) {
 	assert.NotEqual(t, nil, err)
 }
 
+func TestWalkWithoutPruning(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	assert.Equal(t, nil, err)
+	defer os.RemoveAll(dir)
+
+	emptyDir := filepath.Join(dir, "empty")
+	os.MkdirAll(emptyDir, os.ModePerm)
+	fileA := filepath.Join(dir, "a.go")
+	err = ioutil.WriteFile(fileA, []byte("test"), 0644)
+	assert.Equal(t, nil, err)
+
+	files, err := listAndPruneDir(dir, nil, false)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, map[string]bool{fileA: true}, files)
+
+	// make sure empty dirs are kept
+	_, err = os.Stat(emptyDir)
+	assert.Equal(t, nil, err)
+}
+
 func TestWalkAndExcludeDir(t *testing.T) {
 	dir, err := ioutil.TempDir("", "")
 	assert.Equal(t, nil, err)
@@ -66,7 +86,7 @@ func TestWalkAndExcludeDir(t *testing.T) {
 	pycFile := filepath.Join(cacheDir, "foo.pyc")
 	err = ioutil.WriteFile(pycFile, []byte("test2"), 0644)
 
-	files, err := listAndPruneDir(dir, []string{"__pycache__/**"})
+	files, err := listAndPruneDir(dir, newPathMatcher([]string{"__pycache__/**"}), true)
 	assert.Equal(t, nil, err)
 	assert.Equal(t, true, files[pycFile])
 
@@ -101,7 +121,7 @@ func TestWalkAndExcludeNestedDirs(t *testing.T) {
 	pycFile := filepath.Join(cacheDir, "foo.pyc")
 	err = ioutil.WriteFile(pycFile, []byte("test2"), 0644)
 
-	files, err := listAndPruneDir(dir, []string{"**/__pycache__/**"})
+	files, err := listAndPruneDir(dir, newPathMatcher([]string{"**/__pycache__/**"}), true)
 	assert.Equal(t, nil, err)
 	assert.Equal(t, 0, len(files))
 
@@ -130,7 +150,7 @@ func TestWalkAndExcludeFile(t *testing.T) {
 	pyFile2 := filepath.Join(cacheDir, "bar.py")
 	err = ioutil.WriteFile(pyFile2, []byte("test2"), 0644)
 
-	files, err := listAndPruneDir(dir, []string{"foo/**/*.py"})
+	files, err := listAndPruneDir(dir, newPathMatcher([]string{"foo/**/*.py"}), true)
 	assert.Equal(t, nil, err)
 	assert.Equal(t, 1, len(files))
 	// all *.py file should be excluded
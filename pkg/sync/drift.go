@@ -0,0 +1,168 @@
+package sync
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+)
+
+const (
+	// compare size and mtime of local files with the ones recorded after
+	// download
+	DriftCompareSizeMtime = "size-mtime"
+	// compare SHA-256 of local files as well, which detects edits that keep
+	// size and mtime at the cost of reading all files on every check
+	DriftCompareSHA256 = "sha256"
+
+	// only log drifted files and count them in metrics
+	DriftActionReport = "report"
+	// download remote version of drifted files again on the next pull
+	DriftActionRestore = "restore"
+)
+
+var metricsFileDrifted = prometheus.NewGauge(prometheus.GaugeOpts{
+	Namespace: "objinsync",
+	Subsystem: "pull",
+	Name:      "files_drifted",
+	Help:      "Number of local files modified or deleted outside of objinsync found by the last drift check.",
+})
+
+func init() {
+	prometheus.MustRegister(metricsFileDrifted)
+}
+
+// localFileState is the state of a local file right after it was synced.
+type localFileState struct {
+	size  int64
+	mtime time.Time
+	// hex encoded, only recorded in sha256 drift compare mode
+	sha256 string
+}
+
+// SetDriftDetection makes pulls check local files for changes made outside of
+// objinsync at most once per interval.
+func (self *Puller) SetDriftDetection(interval time.Duration, compare string, action string) error {
+	switch compare {
+	case DriftCompareSizeMtime, DriftCompareSHA256:
+	default:
+		return fmt.Errorf("unsupported drift compare mode: %s", compare)
+	}
+	switch action {
+	case DriftActionReport, DriftActionRestore:
+	default:
+		return fmt.Errorf("unsupported drift action: %s", action)
+	}
+	self.driftInterval = interval
+	self.driftCompare = compare
+	self.driftAction = action
+	return nil
+}
+
+func (self *Puller) readLocalFileState(path string) (localFileState, error) {
+	info, err := os.Lstat(path)
+	if err != nil {
+		return localFileState{}, err
+	}
+	state := localFileState{size: info.Size(), mtime: info.ModTime()}
+	if self.driftCompare == DriftCompareSHA256 && info.Mode().IsRegular() {
+		state.sha256, err = sha256HexFromLocalPath(path)
+		if err != nil {
+			return localFileState{}, err
+		}
+	}
+	return state, nil
+}
+
+// recordLocalState remembers state of a local file which is in sync with
+// remote.
+func (self *Puller) recordLocalState(uidKey string, localPath string) {
+	if self.driftInterval <= 0 {
+		return
+	}
+	state, err := self.readLocalFileState(localPath)
+	if err != nil {
+		zap.S().Errorf("Failed to record state of %s for drift detection: %v", localPath, err)
+		return
+	}
+	self.uidLock.Lock()
+	self.localStates[uidKey] = state
+	self.uidLock.Unlock()
+}
+
+// driftReason compares current state of a local file with the recorded one,
+// empty string means the file hasn't drifted.
+func driftReason(recorded localFileState, current localFileState, err error) string {
+	switch {
+	case os.IsNotExist(err):
+		return "deleted"
+	case err != nil:
+		return err.Error()
+	case current.size != recorded.size:
+		return fmt.Sprintf("size changed from %d to %d", recorded.size, current.size)
+	case !current.mtime.Equal(recorded.mtime):
+		return fmt.Sprintf("mtime changed from %v to %v", recorded.mtime, current.mtime)
+	case current.sha256 != recorded.sha256:
+		return "content changed"
+	}
+	return ""
+}
+
+// checkDrift compares local files with their recorded state if drift check
+// interval has passed since the last check. In restore mode, drifted files
+// are marked for restoreDrifted.
+func (self *Puller) checkDrift(now time.Time) {
+	l := zap.S()
+
+	if self.driftInterval <= 0 || now.Sub(self.lastDriftCheck) < self.driftInterval {
+		return
+	}
+	self.lastDriftCheck = now
+
+	self.uidLock.Lock()
+	recorded := make(map[string]localFileState, len(self.localStates))
+	for uidKey, state := range self.localStates {
+		recorded[uidKey] = state
+	}
+	self.uidLock.Unlock()
+
+	drifted := 0
+	self.driftedKeys = map[string]bool{}
+	for uidKey, state := range recorded {
+		localPath := filepath.Join(self.LocalDir, uidKey)
+		current, err := self.readLocalFileState(localPath)
+		reason := driftReason(state, current, err)
+		if reason == "" {
+			continue
+		}
+
+		drifted += 1
+		l.Warnf("Local file %s drifted from remote version: %s", localPath, reason)
+		if self.driftAction == DriftActionRestore {
+			self.driftedKeys[uidKey] = true
+		}
+	}
+	metricsFileDrifted.Set(float64(drifted))
+}
+
+// restoreDrifted removes files marked by checkDrift from uid cache so they
+// are downloaded again. It's only called by pulls that apply changes, so
+// drifted files stay marked while waiting for a commit.
+func (self *Puller) restoreDrifted() {
+	if len(self.driftedKeys) == 0 {
+		return
+	}
+
+	self.uidLock.Lock()
+	for uidKey := range self.driftedKeys {
+		delete(self.uidCache, uidKey)
+		delete(self.localSums, uidKey)
+		delete(self.localStates, uidKey)
+	}
+	self.uidLock.Unlock()
+	zap.S().Infof("Restoring %d drifted files from remote", len(self.driftedKeys))
+	self.driftedKeys = map[string]bool{}
+}
@@ -0,0 +1,137 @@
+package sync
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSetDriftDetection(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	assert.Equal(t, nil, err)
+	defer os.RemoveAll(dir)
+
+	p, err := NewPuller("s3://foo/home", dir)
+	assert.Equal(t, nil, err)
+	assert.NotEqual(t, nil, p.SetDriftDetection(time.Minute, "md5", DriftActionReport))
+	assert.NotEqual(t, nil, p.SetDriftDetection(time.Minute, DriftCompareSHA256, "fix"))
+	assert.Equal(t, nil, p.SetDriftDetection(time.Minute, DriftCompareSHA256, DriftActionRestore))
+}
+
+func TestCheckDrift(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	assert.Equal(t, nil, err)
+	defer os.RemoveAll(dir)
+
+	p, err := NewPuller("s3://foo/home", dir)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, nil, p.SetupWorkingDir())
+	assert.Equal(t, nil, p.SetDriftDetection(time.Minute, DriftCompareSizeMtime, DriftActionReport))
+
+	for _, name := range []string{"a.py", "b.py", "c.py"} {
+		assert.Equal(t, nil, p.installDownload(
+			DownloadTask{LocalPath: filepath.Join(dir, name), UidKey: name, Uid: name},
+			writeTmpDownload(t, p, name, "content")))
+	}
+	assert.Equal(t, 3, len(p.localStates))
+
+	assert.Equal(t, nil, ioutil.WriteFile(filepath.Join(dir, "a.py"), []byte("edited locally"), 0644))
+	assert.Equal(t, nil, os.Remove(filepath.Join(dir, "b.py")))
+
+	// drifted files are only reported
+	now := time.Now()
+	p.checkDrift(now)
+	assert.Equal(t, 3, len(p.uidCache))
+
+	// check is skipped until interval passes
+	p.driftAction = DriftActionRestore
+	p.checkDrift(now.Add(time.Second))
+	assert.Equal(t, 3, len(p.uidCache))
+
+	p.checkDrift(now.Add(time.Minute))
+	assert.Equal(t, 3, len(p.uidCache))
+	p.restoreDrifted()
+	assert.Equal(t, map[string]string{"c.py": "c.py"}, p.uidCache)
+	assert.Equal(t, 1, len(p.localStates))
+}
+
+func TestCheckDriftWithSHA256(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	assert.Equal(t, nil, err)
+	defer os.RemoveAll(dir)
+
+	p, err := NewPuller("s3://foo/home", dir)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, nil, p.SetupWorkingDir())
+	assert.Equal(t, nil, p.SetDriftDetection(time.Minute, DriftCompareSHA256, DriftActionRestore))
+
+	path := filepath.Join(dir, "a.py")
+	assert.Equal(t, nil, p.installDownload(
+		DownloadTask{LocalPath: path, UidKey: "a.py", Uid: "a"},
+		writeTmpDownload(t, p, "a", "content")))
+
+	// edit keeping size and mtime
+	info, err := os.Stat(path)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, nil, ioutil.WriteFile(path, []byte("CONTENT"), 0644))
+	assert.Equal(t, nil, os.Chtimes(path, info.ModTime(), info.ModTime()))
+
+	p.checkDrift(time.Now())
+	p.restoreDrifted()
+	assert.Equal(t, 0, len(p.uidCache))
+}
+
+func TestRestoreDriftWithCommitMarker(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	assert.Equal(t, nil, err)
+	defer os.RemoveAll(dir)
+
+	p, err := NewPuller("s3://foo/home", dir)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, nil, p.SetupWorkingDir())
+	assert.Equal(t, nil, p.SetDriftDetection(time.Minute, DriftCompareSizeMtime, DriftActionRestore))
+	p.CommitMarker = "_SUCCESS"
+
+	header := &MockObjectHeader{head: &s3.HeadObjectOutput{
+		ETag: aws.String("\"1\""), LastModified: aws.Time(time.Now())}}
+	id, ready, err := p.checkCommitMarker(header, "foo", "home")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, true, ready)
+	p.appliedCommit = id
+
+	path := filepath.Join(dir, "a.py")
+	assert.Equal(t, nil, p.installDownload(
+		DownloadTask{LocalPath: path, UidKey: "a.py", Uid: "a"},
+		writeTmpDownload(t, p, "a", "content")))
+	assert.Equal(t, nil, os.Remove(path))
+
+	// drift is reported while waiting for commit, cache is kept until the
+	// next commit is pulled
+	now := time.Now()
+	p.checkDrift(now)
+	_, ready, err = p.checkCommitMarker(header, "foo", "home")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, false, ready)
+	assert.Equal(t, 1, len(p.uidCache))
+	assert.Equal(t, 1, len(p.localStates))
+
+	// still drifted on the next check
+	p.checkDrift(now.Add(time.Minute))
+	assert.Equal(t, map[string]bool{"a.py": true}, p.driftedKeys)
+
+	header.head = &s3.HeadObjectOutput{
+		ETag: aws.String("\"2\""), LastModified: aws.Time(time.Now())}
+	_, ready, err = p.checkCommitMarker(header, "foo", "home")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, true, ready)
+	p.restoreDrifted()
+	assert.Equal(t, 0, len(p.uidCache))
+	assert.Equal(t, 0, len(p.localStates))
+	assert.Equal(t, 0, len(p.driftedKeys))
+}
@@ -0,0 +1,74 @@
+package sync
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+var byteSizeUnits = []struct {
+	suffix string
+	size   int64
+}{
+	{"KIB", 1 << 10},
+	{"MIB", 1 << 20},
+	{"GIB", 1 << 30},
+	{"TIB", 1 << 40},
+	{"KB", 1 << 10},
+	{"MB", 1 << 20},
+	{"GB", 1 << 30},
+	{"TB", 1 << 40},
+	{"K", 1 << 10},
+	{"M", 1 << 20},
+	{"G", 1 << 30},
+	{"T", 1 << 40},
+	{"B", 1},
+}
+
+// ParseByteSize parses human readable size like `512`, `10K`, `1.5GiB`. All
+// units are treated as power of 1024.
+func ParseByteSize(s string) (int64, error) {
+	str := strings.ToUpper(strings.TrimSpace(s))
+	multiplier := int64(1)
+	for _, unit := range byteSizeUnits {
+		if strings.HasSuffix(str, unit.suffix) {
+			multiplier = unit.size
+			str = strings.TrimSpace(strings.TrimSuffix(str, unit.suffix))
+			break
+		}
+	}
+
+	val, err := strconv.ParseFloat(str, 64)
+	if err != nil || val < 0 {
+		return 0, fmt.Errorf("invalid byte size: %s", s)
+	}
+	return int64(val * float64(multiplier)), nil
+}
+
+// filterObject returns the reason why given object should be skipped based on
+// size and age filters or commit marker, empty string means the object should
+// be synced.
+func (self *Puller) filterObject(obj *s3.Object, now time.Time) string {
+	if self.MaxSize > 0 && obj.Size != nil && *obj.Size > self.MaxSize {
+		return fmt.Sprintf("size %d is larger than %d", *obj.Size, self.MaxSize)
+	}
+
+	if obj.LastModified != nil {
+		age := now.Sub(*obj.LastModified)
+		if self.MinAge > 0 && age < self.MinAge {
+			return fmt.Sprintf("age %v is less than %v", age, self.MinAge)
+		}
+		if self.MaxAge > 0 && age > self.MaxAge {
+			return fmt.Sprintf("age %v is more than %v", age, self.MaxAge)
+		}
+	}
+
+	if !self.commitTime.IsZero() && obj.LastModified != nil && obj.LastModified.After(self.commitTime) {
+		return fmt.Sprintf("modified after commit marker at %v", self.commitTime)
+	}
+
+	return ""
+}
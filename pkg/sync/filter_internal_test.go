@@ -0,0 +1,109 @@
+package sync
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseByteSize(t *testing.T) {
+	for input, expected := range map[string]int64{
+		"512":    512,
+		"10K":    10 * 1024,
+		"10kb":   10 * 1024,
+		"1.5GiB": 3 * 512 * 1024 * 1024,
+		"2 M":    2 * 1024 * 1024,
+		"7B":     7,
+	} {
+		size, err := ParseByteSize(input)
+		assert.Equal(t, nil, err)
+		assert.Equal(t, expected, size, input)
+	}
+
+	for _, input := range []string{"", "abc", "-1K", "10X"} {
+		_, err := ParseByteSize(input)
+		assert.NotEqual(t, nil, err, input)
+	}
+}
+
+func TestSkipFilteredObjects(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	assert.Equal(t, nil, err)
+	defer os.RemoveAll(dir)
+
+	bigFile := filepath.Join(dir, "big.dump")
+	err = ioutil.WriteFile(bigFile, []byte("test"), 0644)
+	assert.Equal(t, nil, err)
+	staleFile := filepath.Join(dir, "stale.file")
+	err = ioutil.WriteFile(staleFile, []byte("test"), 0644)
+	assert.Equal(t, nil, err)
+
+	p, err := NewPuller("s3://foo/home", dir)
+	assert.Equal(t, nil, err)
+	p.MaxSize = 1024
+	p.MinAge = time.Minute
+	p.MaxAge = 24 * time.Hour
+	p.taskQueue = make(chan DownloadTask, 10)
+	p.filesToDelete, err = listAndPruneDir(dir, nil, true)
+	assert.Equal(t, nil, err)
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		// drain queue
+		for _ = range p.taskQueue {
+		}
+		wg.Done()
+	}()
+
+	now := time.Now()
+	p.handlePageList(
+		&s3.ListObjectsV2Output{
+			Contents: []*s3.Object{
+				&s3.Object{
+					Key:          aws.String("home/a.py"),
+					ETag:         aws.String("\"1\""),
+					Size:         aws.Int64(10),
+					LastModified: aws.Time(now.Add(-time.Hour)),
+				},
+				&s3.Object{
+					Key:          aws.String("home/big.dump"),
+					ETag:         aws.String("\"2\""),
+					Size:         aws.Int64(1024 * 1024),
+					LastModified: aws.Time(now.Add(-time.Hour)),
+				},
+				&s3.Object{
+					Key:          aws.String("home/fresh.py"),
+					ETag:         aws.String("\"3\""),
+					Size:         aws.Int64(10),
+					LastModified: aws.Time(now),
+				},
+				&s3.Object{
+					Key:          aws.String("home/stale.file"),
+					ETag:         aws.String("\"4\""),
+					Size:         aws.Int64(10),
+					LastModified: aws.Time(now.Add(-48 * time.Hour)),
+				},
+			},
+		},
+		false,
+		"foo",
+		"home",
+		dir,
+	)
+	close(p.taskQueue)
+	wg.Wait()
+
+	assert.Equal(t, 4, p.fileListedCnt)
+	assert.Equal(t, 1, p.filePulledCnt)
+	assert.Equal(t, 3, p.fileSkippedCnt)
+	// local copies of skipped objects should not be deleted
+	assert.Equal(t, 0, len(p.filesToDelete))
+}
@@ -0,0 +1,381 @@
+package sync
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	historyJournalFile = "journal.json"
+	historyFilesDir    = "files"
+	historyIdFormat    = "20060102T150405.000Z"
+	// paths changed by rollback, which a running puller needs to forget
+	historyRolledBackFile = "rolled_back.json"
+)
+
+// HistoryCycle records local changes made by a pull cycle. Previous versions
+// of replaced and deleted files are kept in the cycle directory so the cycle
+// can be rolled back.
+type HistoryCycle struct {
+	Id       string   `json:"id"`
+	LocalDir string   `json:"local_dir"`
+	Created  []string `json:"created,omitempty"`
+	Replaced []string `json:"replaced,omitempty"`
+	Deleted  []string `json:"deleted,omitempty"`
+}
+
+func (self *HistoryCycle) empty() bool {
+	return len(self.Created) == 0 && len(self.Replaced) == 0 && len(self.Deleted) == 0
+}
+
+// historyRecorder keeps previous versions of files changed by a single pull.
+type historyRecorder struct {
+	dir   string
+	cycle HistoryCycle
+	lock  sync.Mutex
+}
+
+func newHistoryRecorder(historyDir string, localDir string, start time.Time) *historyRecorder {
+	id := start.UTC().Format(historyIdFormat)
+	if absDir, err := filepath.Abs(localDir); err == nil {
+		localDir = absDir
+	}
+	return &historyRecorder{
+		dir:   filepath.Join(historyDir, id),
+		cycle: HistoryCycle{Id: id, LocalDir: localDir},
+	}
+}
+
+// preserveReplaced keeps a hard link to the local file about to be replaced,
+// so the replacement itself can still be done with an atomic rename.
+func (self *historyRecorder) preserveReplaced(relPath string, localPath string) error {
+	if _, err := os.Lstat(localPath); os.IsNotExist(err) {
+		self.lock.Lock()
+		self.cycle.Created = append(self.cycle.Created, relPath)
+		self.lock.Unlock()
+		return nil
+	}
+
+	if err := copyOrLinkFile(localPath, self.historyPath(relPath)); err != nil {
+		return err
+	}
+	self.lock.Lock()
+	self.cycle.Replaced = append(self.cycle.Replaced, relPath)
+	self.lock.Unlock()
+	return nil
+}
+
+// moveDeleted moves the local file into history instead of removing it.
+func (self *historyRecorder) moveDeleted(relPath string, localPath string) error {
+	if err := moveFile(localPath, self.historyPath(relPath)); err != nil {
+		return err
+	}
+	self.lock.Lock()
+	self.cycle.Deleted = append(self.cycle.Deleted, relPath)
+	self.lock.Unlock()
+	return nil
+}
+
+func (self *historyRecorder) historyPath(relPath string) string {
+	return filepath.Join(self.dir, historyFilesDir, relPath)
+}
+
+// save writes the journal of the cycle, cycles without changes are not kept.
+func (self *historyRecorder) save() error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	if self.cycle.empty() {
+		return os.RemoveAll(self.dir)
+	}
+	if err := os.MkdirAll(self.dir, os.ModePerm); err != nil {
+		return err
+	}
+	content, err := json.MarshalIndent(self.cycle, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(self.dir, historyJournalFile), content, 0644)
+}
+
+// SetHistory keeps previous versions of files replaced or deleted by the last
+// cycles pulls in historyDir, so they can be restored with Rollback.
+func (self *Puller) SetHistory(historyDir string, cycles int) error {
+	if cycles < 1 {
+		return fmt.Errorf("number of history cycles must be positive, got %d", cycles)
+	}
+	historyDir, err := self.absDirOutsideLocalDir(historyDir)
+	if err != nil {
+		return fmt.Errorf("invalid history dir: %v", err)
+	}
+	self.historyDir = historyDir
+	self.historyCycles = cycles
+	return nil
+}
+
+// absDirOutsideLocalDir returns absolute path of given dir, which must not
+// overlap with local dir. Files kept there would be pruned or picked up by
+// consumers of local dir otherwise.
+func (self *Puller) absDirOutsideLocalDir(dir string) (string, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return "", err
+	}
+	localDir, err := filepath.Abs(self.LocalDir)
+	if err != nil {
+		return "", err
+	}
+	if isPathWithinDir(localDir, dir) || isPathWithinDir(dir, localDir) {
+		return "", fmt.Errorf("%s can't overlap with local dir %s", dir, localDir)
+	}
+	return dir, nil
+}
+
+// finishHistory saves the cycle journal and drops cycles beyond retention.
+func (self *Puller) finishHistory() {
+	l := zap.S()
+
+	if err := self.history.save(); err != nil {
+		l.Errorf("Failed to save history of cycle %s: %v", self.history.cycle.Id, err)
+	}
+	self.history = nil
+
+	cycles, err := ListHistory(self.historyDir)
+	if err != nil {
+		l.Errorf("Failed to list history dir %s: %v", self.historyDir, err)
+		return
+	}
+	for i := 0; i < len(cycles)-self.historyCycles; i++ {
+		l.Debugf("Purging history cycle %s", cycles[i].Id)
+		os.RemoveAll(filepath.Join(self.historyDir, cycles[i].Id))
+	}
+}
+
+// ListHistory returns recorded cycles from oldest to newest.
+func ListHistory(historyDir string) ([]HistoryCycle, error) {
+	entries, err := ioutil.ReadDir(historyDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	cycles := []HistoryCycle{}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		content, err := ioutil.ReadFile(filepath.Join(historyDir, entry.Name(), historyJournalFile))
+		if err != nil {
+			// cycle is still in progress or was interrupted
+			continue
+		}
+		var cycle HistoryCycle
+		if err := json.Unmarshal(content, &cycle); err != nil {
+			return nil, fmt.Errorf("invalid journal for cycle %s: %v", entry.Name(), err)
+		}
+		cycles = append(cycles, cycle)
+	}
+	sort.Slice(cycles, func(i, j int) bool { return cycles[i].Id < cycles[j].Id })
+	return cycles, nil
+}
+
+// Rollback restores local dir to the state before given cycle by undoing it
+// and all newer cycles, newest first. The latest cycle is rolled back if
+// cycleId is empty. Ids of rolled back cycles are returned.
+func Rollback(localDir string, historyDir string, cycleId string) ([]string, error) {
+	cycles, err := ListHistory(historyDir)
+	if err != nil {
+		return nil, err
+	}
+	if len(cycles) == 0 {
+		return nil, fmt.Errorf("no history found in %s", historyDir)
+	}
+	if cycleId == "" {
+		cycleId = cycles[len(cycles)-1].Id
+	}
+
+	start := -1
+	for i, cycle := range cycles {
+		if cycle.Id == cycleId {
+			start = i
+		}
+	}
+	if start < 0 {
+		return nil, fmt.Errorf("cycle %s not found in %s", cycleId, historyDir)
+	}
+
+	localDir, err = filepath.Abs(localDir)
+	if err != nil {
+		return nil, err
+	}
+	rolledBack := []string{}
+	for i := len(cycles) - 1; i >= start; i-- {
+		cycle := cycles[i]
+		if cycle.LocalDir != localDir {
+			return rolledBack, fmt.Errorf("cycle %s was recorded for %s, not %s", cycle.Id, cycle.LocalDir, localDir)
+		}
+		err := rollbackCycle(localDir, filepath.Join(historyDir, cycle.Id), cycle)
+		// files of a partially rolled back cycle may have changed as well
+		paths := append(append(append([]string{}, cycle.Created...), cycle.Replaced...), cycle.Deleted...)
+		if recordErr := recordRolledBack(historyDir, paths); recordErr != nil {
+			return rolledBack, fmt.Errorf("failed to record rolled back files: %v", recordErr)
+		}
+		if err != nil {
+			return rolledBack, fmt.Errorf("failed to roll back cycle %s: %v", cycle.Id, err)
+		}
+		rolledBack = append(rolledBack, cycle.Id)
+	}
+	return rolledBack, nil
+}
+
+// recordRolledBack adds paths to the list of rolled back files read by
+// forgetRolledBack.
+func recordRolledBack(historyDir string, paths []string) error {
+	listPath := filepath.Join(historyDir, historyRolledBackFile)
+	recorded, err := readRolledBack(listPath)
+	if err != nil {
+		return err
+	}
+	content, err := json.Marshal(append(recorded, paths...))
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(listPath, content, 0644)
+}
+
+func readRolledBack(listPath string) ([]string, error) {
+	content, err := ioutil.ReadFile(listPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var paths []string
+	if err := json.Unmarshal(content, &paths); err != nil {
+		return nil, fmt.Errorf("invalid list of rolled back files %s: %v", listPath, err)
+	}
+	return paths, nil
+}
+
+// forgetRolledBack drops cached state of files changed by rollback since the
+// last pull, so local files no longer match what uid cache says about them
+// and the pull restores the remote state.
+func (self *Puller) forgetRolledBack() {
+	l := zap.S()
+
+	listPath := filepath.Join(self.historyDir, historyRolledBackFile)
+	paths, err := readRolledBack(listPath)
+	if err != nil {
+		l.Errorf("Failed to read rolled back files: %v", err)
+		return
+	}
+	if len(paths) == 0 {
+		return
+	}
+
+	self.uidLock.Lock()
+	for _, relPath := range paths {
+		delete(self.uidCache, relPath)
+		delete(self.localSums, relPath)
+		delete(self.localStates, relPath)
+	}
+	self.uidLock.Unlock()
+	l.Infof("%d files were changed by rollback, restoring them from remote", len(paths))
+
+	if err := os.Remove(listPath); err != nil {
+		l.Errorf("Failed to remove list of rolled back files %s: %v", listPath, err)
+	}
+}
+
+func rollbackCycle(localDir string, cycleDir string, cycle HistoryCycle) error {
+	for _, relPath := range cycle.Created {
+		localPath, err := safeLocalPath(localDir, relPath)
+		if err != nil {
+			return err
+		}
+		if err := os.Remove(localPath); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	restore := append(append([]string{}, cycle.Replaced...), cycle.Deleted...)
+	for _, relPath := range restore {
+		localPath, err := safeLocalPath(localDir, relPath)
+		if err != nil {
+			return err
+		}
+		if err := moveFile(filepath.Join(cycleDir, historyFilesDir, relPath), localPath); err != nil {
+			return err
+		}
+	}
+	return os.RemoveAll(cycleDir)
+}
+
+// copyOrLinkFile hard links src to dst, falling back to a copy if src is on a
+// different device. Symlinks are preserved as symlinks.
+func copyOrLinkFile(src string, dst string) error {
+	if err := os.MkdirAll(filepath.Dir(dst), os.ModePerm); err != nil {
+		return err
+	}
+	os.Remove(dst)
+	if err := os.Link(src, dst); err == nil {
+		return nil
+	}
+
+	info, err := os.Lstat(src)
+	if err != nil {
+		return err
+	}
+	if info.Mode()&os.ModeSymlink != 0 {
+		target, err := os.Readlink(src)
+		if err != nil {
+			return err
+		}
+		return os.Symlink(target, dst)
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	return os.Chtimes(dst, info.ModTime(), info.ModTime())
+}
+
+// moveFile renames src to dst, falling back to copy and remove if they are on
+// different devices.
+func moveFile(src string, dst string) error {
+	if err := os.MkdirAll(filepath.Dir(dst), os.ModePerm); err != nil {
+		return err
+	}
+	if err := os.Rename(src, dst); err == nil {
+		return nil
+	}
+	if err := copyOrLinkFile(src, dst); err != nil {
+		return err
+	}
+	return os.Remove(src)
+}
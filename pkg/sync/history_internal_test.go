@@ -0,0 +1,210 @@
+package sync
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/stretchr/testify/assert"
+)
+
+func writeTmpDownload(t *testing.T, p *Puller, name string, content string) string {
+	path := filepath.Join(p.workingDir, name)
+	assert.Equal(t, nil, ioutil.WriteFile(path, []byte(content), 0644))
+	return path
+}
+
+func TestSetHistory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	assert.Equal(t, nil, err)
+	defer os.RemoveAll(dir)
+	assert.Equal(t, nil, os.MkdirAll(filepath.Join(dir, "dags"), os.ModePerm))
+
+	p, err := NewPuller("s3://foo/home", filepath.Join(dir, "dags"))
+	assert.Equal(t, nil, err)
+	assert.NotEqual(t, nil, p.SetHistory(filepath.Join(dir, "dags", "history"), 3))
+	assert.NotEqual(t, nil, p.SetHistory(dir, 3))
+	assert.NotEqual(t, nil, p.SetHistory(filepath.Join(dir, "history"), 0))
+	assert.Equal(t, nil, p.SetHistory(filepath.Join(dir, "history"), 3))
+}
+
+func TestHistoryRollback(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	assert.Equal(t, nil, err)
+	defer os.RemoveAll(dir)
+
+	localDir := filepath.Join(dir, "dags")
+	historyDir := filepath.Join(dir, "history")
+	assert.Equal(t, nil, os.MkdirAll(localDir, os.ModePerm))
+	assert.Equal(t, nil, ioutil.WriteFile(filepath.Join(localDir, "a.py"), []byte("a1"), 0644))
+	assert.Equal(t, nil, ioutil.WriteFile(filepath.Join(localDir, "b.py"), []byte("b1"), 0644))
+
+	p, err := NewPuller("s3://foo/home", localDir)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, nil, p.SetupWorkingDir())
+	assert.Equal(t, nil, p.SetHistory(historyDir, 2))
+
+	start := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	// first cycle replaces a.py, creates c.py and deletes b.py
+	p.history = newHistoryRecorder(historyDir, localDir, start)
+	assert.Equal(t, nil, p.installDownload(
+		DownloadTask{LocalPath: filepath.Join(localDir, "a.py"), UidKey: "a.py", Uid: "a2"},
+		writeTmpDownload(t, p, "a", "a2")))
+	assert.Equal(t, nil, p.installDownload(
+		DownloadTask{LocalPath: filepath.Join(localDir, "c.py"), UidKey: "c.py", Uid: "c1"},
+		writeTmpDownload(t, p, "c", "c1")))
+	p.removeLocalFile(filepath.Join(localDir, "b.py"), "b.py")
+	p.finishHistory()
+
+	// second cycle replaces a.py again
+	p.history = newHistoryRecorder(historyDir, localDir, start.Add(time.Minute))
+	assert.Equal(t, nil, p.installDownload(
+		DownloadTask{LocalPath: filepath.Join(localDir, "a.py"), UidKey: "a.py", Uid: "a3"},
+		writeTmpDownload(t, p, "a", "a3")))
+	p.finishHistory()
+
+	// cycle without changes is not recorded
+	p.history = newHistoryRecorder(historyDir, localDir, start.Add(2*time.Minute))
+	p.finishHistory()
+
+	cycles, err := ListHistory(historyDir)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 2, len(cycles))
+	assert.Equal(t, "20230101T000000.000Z", cycles[0].Id)
+	assert.Equal(t, []string{"a.py"}, cycles[0].Replaced)
+	assert.Equal(t, []string{"c.py"}, cycles[0].Created)
+	assert.Equal(t, []string{"b.py"}, cycles[0].Deleted)
+
+	readLocal := func(name string) string {
+		content, err := ioutil.ReadFile(filepath.Join(localDir, name))
+		if err != nil {
+			return ""
+		}
+		return string(content)
+	}
+
+	// roll back the latest cycle
+	rolledBack, err := Rollback(localDir, historyDir, "")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, []string{"20230101T000100.000Z"}, rolledBack)
+	assert.Equal(t, "a2", readLocal("a.py"))
+
+	// roll back everything since given cycle
+	p.history = newHistoryRecorder(historyDir, localDir, start.Add(3*time.Minute))
+	assert.Equal(t, nil, p.installDownload(
+		DownloadTask{LocalPath: filepath.Join(localDir, "c.py"), UidKey: "c.py", Uid: "c2"},
+		writeTmpDownload(t, p, "c", "c2")))
+	p.finishHistory()
+	rolledBack, err = Rollback(localDir, historyDir, "20230101T000000.000Z")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, []string{"20230101T000300.000Z", "20230101T000000.000Z"}, rolledBack)
+	assert.Equal(t, "a1", readLocal("a.py"))
+	assert.Equal(t, "b1", readLocal("b.py"))
+	assert.Equal(t, "", readLocal("c.py"))
+
+	cycles, err = ListHistory(historyDir)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 0, len(cycles))
+	_, err = Rollback(localDir, historyDir, "")
+	assert.NotEqual(t, nil, err)
+}
+
+func TestHistoryRetention(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	assert.Equal(t, nil, err)
+	defer os.RemoveAll(dir)
+
+	localDir := filepath.Join(dir, "dags")
+	historyDir := filepath.Join(dir, "history")
+	assert.Equal(t, nil, os.MkdirAll(localDir, os.ModePerm))
+
+	p, err := NewPuller("s3://foo/home", localDir)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, nil, p.SetupWorkingDir())
+	assert.Equal(t, nil, p.SetHistory(historyDir, 2))
+
+	start := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 4; i++ {
+		p.history = newHistoryRecorder(historyDir, localDir, start.Add(time.Duration(i)*time.Minute))
+		assert.Equal(t, nil, p.installDownload(
+			DownloadTask{LocalPath: filepath.Join(localDir, "a.py"), UidKey: "a.py", Uid: "a"},
+			writeTmpDownload(t, p, "a", "a")))
+		p.finishHistory()
+	}
+
+	cycles, err := ListHistory(historyDir)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 2, len(cycles))
+	assert.Equal(t, "20230101T000200.000Z", cycles[0].Id)
+	assert.Equal(t, "20230101T000300.000Z", cycles[1].Id)
+}
+
+func TestPullAfterRollback(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	assert.Equal(t, nil, err)
+	defer os.RemoveAll(dir)
+
+	localDir := filepath.Join(dir, "dags")
+	historyDir := filepath.Join(dir, "history")
+	assert.Equal(t, nil, os.MkdirAll(localDir, os.ModePerm))
+	assert.Equal(t, nil, ioutil.WriteFile(filepath.Join(localDir, "a.py"), []byte("a1"), 0644))
+	assert.Equal(t, nil, ioutil.WriteFile(filepath.Join(localDir, "b.py"), []byte("b1"), 0644))
+
+	p, err := NewPuller("s3://foo/home", localDir)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, nil, p.SetupWorkingDir())
+	assert.Equal(t, nil, p.SetHistory(historyDir, 2))
+	p.PopulateChecksum()
+
+	// pull replaces a.py, creates c.py and deletes b.py
+	p.history = newHistoryRecorder(historyDir, localDir, time.Now())
+	assert.Equal(t, nil, p.installDownload(
+		DownloadTask{LocalPath: filepath.Join(localDir, "a.py"), UidKey: "a.py", Uid: "\"a2\""},
+		writeTmpDownload(t, p, "a", "a2")))
+	assert.Equal(t, nil, p.installDownload(
+		DownloadTask{LocalPath: filepath.Join(localDir, "c.py"), UidKey: "c.py", Uid: "\"c1\""},
+		writeTmpDownload(t, p, "c", "c1")))
+	p.removeLocalFile(filepath.Join(localDir, "b.py"), "b.py")
+	delete(p.uidCache, "b.py")
+	p.finishHistory()
+
+	// rollback runs while the puller keeps running
+	_, err = Rollback(localDir, historyDir, "")
+	assert.Equal(t, nil, err)
+
+	// next pull of unchanged remote restores the remote state
+	p.forgetRolledBack()
+	assert.Equal(t, 0, len(p.uidCache))
+	filesToDelete, err := listAndPruneDir(localDir, p.matcher, true)
+	assert.Equal(t, nil, err)
+	p.filesToDelete = filesToDelete
+	p.taskQueue = make(chan DownloadTask, 10)
+	p.handlePageList(
+		&s3.ListObjectsV2Output{
+			Contents: []*s3.Object{
+				&s3.Object{Key: aws.String("home/a.py"), ETag: aws.String("\"a2\"")},
+				&s3.Object{Key: aws.String("home/c.py"), ETag: aws.String("\"c1\"")},
+			},
+		},
+		true,
+		"foo",
+		"home",
+		localDir,
+	)
+	close(p.taskQueue)
+	pulled := []string{}
+	for task := range p.taskQueue {
+		pulled = append(pulled, task.UidKey)
+	}
+	assert.Equal(t, []string{"a.py", "c.py"}, pulled)
+	assert.Equal(t, map[string]bool{filepath.Join(localDir, "b.py"): true}, p.filesToDelete)
+
+	// list of rolled back files is only applied once
+	_, err = os.Stat(filepath.Join(historyDir, historyRolledBackFile))
+	assert.Equal(t, true, os.IsNotExist(err))
+}
@@ -0,0 +1,228 @@
+package sync
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"github.com/bmatcuk/doublestar"
+)
+
+// name of the gitignore style file looked up under the remote prefix
+const RemoteIgnoreFile = ".objinsyncignore"
+
+// isRemoteIgnoreFile reports whether object at relPath is the remote ignore
+// file, which is read by the puller and not synced.
+func (self *Puller) isRemoteIgnoreFile(relPath string) bool {
+	return self.RemoteIgnore && relPath == RemoteIgnoreFile
+}
+
+// ignoreRule is a single parsed line from a gitignore style file.
+type ignoreRule struct {
+	// doublestar pattern matched against slash separated relative paths
+	pattern string
+	negate  bool
+	dirOnly bool
+}
+
+// parseIgnoreRules parses content written in gitignore syntax. Rules are
+// returned in the order they appear since the last matching rule wins.
+func parseIgnoreRules(content string) []ignoreRule {
+	var rules []ignoreRule
+	scanner := bufio.NewScanner(strings.NewReader(content))
+	for scanner.Scan() {
+		rule, ok := parseIgnoreLine(scanner.Text())
+		if ok {
+			rules = append(rules, rule)
+		}
+	}
+	return rules
+}
+
+func parseIgnoreLine(line string) (ignoreRule, bool) {
+	rule := ignoreRule{}
+
+	line = strings.TrimSuffix(line, "\r")
+	// trailing spaces are ignored unless they are escaped with backslash
+	for strings.HasSuffix(line, " ") && !strings.HasSuffix(line, "\\ ") {
+		line = line[:len(line)-1]
+	}
+	if line == "" || strings.HasPrefix(line, "#") {
+		return rule, false
+	}
+
+	if strings.HasPrefix(line, "!") {
+		rule.negate = true
+		line = line[1:]
+	} else if strings.HasPrefix(line, "\\!") || strings.HasPrefix(line, "\\#") {
+		line = line[1:]
+	}
+
+	if strings.HasSuffix(line, "/") {
+		rule.dirOnly = true
+		line = strings.TrimRight(line, "/")
+	}
+	if line == "" {
+		return rule, false
+	}
+
+	if strings.Contains(line, "/") {
+		// pattern with a slash at the beginning or in the middle is relative
+		// to the root of the synced directory
+		line = strings.TrimPrefix(line, "/")
+	} else {
+		// otherwise it matches at any level
+		line = "**/" + line
+	}
+	rule.pattern = line
+
+	return rule, true
+}
+
+func (r ignoreRule) String() string {
+	if r.dirOnly {
+		return r.pattern + "/"
+	}
+	return r.pattern
+}
+
+// matchIgnoreRules reports whether relPath is ignored by given rules. Just
+// like git, a path can not be re-included if one of its parent directories is
+// ignored.
+func matchIgnoreRules(rules []ignoreRule, relPath string, isDir bool) bool {
+	return matchingIgnoreRule(rules, relPath, isDir) != nil
+}
+
+// matchingIgnoreRule returns the rule which ignores relPath, nil means
+// relPath is not ignored.
+func matchingIgnoreRule(rules []ignoreRule, relPath string, isDir bool) *ignoreRule {
+	if len(rules) == 0 {
+		return nil
+	}
+
+	relPath = strings.TrimSuffix(filepath.ToSlash(relPath), "/")
+	parts := strings.Split(relPath, "/")
+	for i := 1; i < len(parts); i++ {
+		if rule := matchingIgnoreRuleAt(rules, strings.Join(parts[:i], "/"), true); rule != nil {
+			return rule
+		}
+	}
+	return matchingIgnoreRuleAt(rules, relPath, isDir)
+}
+
+func matchingIgnoreRuleAt(rules []ignoreRule, path string, isDir bool) *ignoreRule {
+	var ignoredBy *ignoreRule
+	for i, rule := range rules {
+		if rule.dirOnly && !isDir {
+			continue
+		}
+		matched, _ := doublestar.Match(rule.pattern, path)
+		if matched {
+			if rule.negate {
+				ignoredBy = nil
+			} else {
+				ignoredBy = &rules[i]
+			}
+		}
+	}
+	return ignoredBy
+}
+
+const (
+	// patterns are matched with doublestar against relative paths
+	PatternSyntaxDoublestar = "doublestar"
+	// patterns are interpreted the same way as lines from .gitignore file
+	PatternSyntaxGitignore = "gitignore"
+)
+
+// pathMatcher decides whether a path relative to the sync root is excluded
+// from the sync. Directory paths are expected to carry a trailing slash so
+// doublestar pattern `foo/**` also matches `foo`.
+type pathMatcher struct {
+	syntax   string
+	patterns []string
+	// compiled from patterns when using gitignore syntax
+	rules []ignoreRule
+	// rules loaded from remote ignore file, they can only exclude more paths
+	remote []ignoreRule
+}
+
+func newPathMatcher(patterns []string) *pathMatcher {
+	m := &pathMatcher{syntax: PatternSyntaxDoublestar}
+	m.addPatterns(patterns)
+	return m
+}
+
+func (m *pathMatcher) setSyntax(syntax string) error {
+	switch syntax {
+	case PatternSyntaxDoublestar, PatternSyntaxGitignore:
+	default:
+		return fmt.Errorf("unsupported pattern syntax: %s", syntax)
+	}
+	m.syntax = syntax
+	m.compile()
+	return nil
+}
+
+func (m *pathMatcher) addPatterns(patterns []string) {
+	m.patterns = append(m.patterns, patterns...)
+	m.compile()
+}
+
+func (m *pathMatcher) compile() {
+	m.rules = nil
+	if m.syntax == PatternSyntaxGitignore {
+		m.rules = parseIgnoreRules(strings.Join(m.patterns, "\n"))
+	}
+}
+
+func (m *pathMatcher) Match(relPath string) bool {
+	return m.explain(relPath) != ""
+}
+
+// explain describes the pattern or rule excluding relPath, empty string means
+// relPath is not excluded.
+func (m *pathMatcher) explain(relPath string) string {
+	if m == nil {
+		return ""
+	}
+
+	isDir := strings.HasSuffix(relPath, "/")
+	if m.syntax == PatternSyntaxGitignore {
+		if rule := matchingIgnoreRule(m.rules, relPath, isDir); rule != nil {
+			return fmt.Sprintf("exclude rule %q", rule.String())
+		}
+	} else {
+		for _, pattern := range m.patterns {
+			matched, _ := doublestar.Match(pattern, relPath)
+			if matched {
+				return fmt.Sprintf("exclude pattern %q", pattern)
+			}
+		}
+	}
+	if rule := matchingIgnoreRule(m.remote, relPath, isDir); rule != nil {
+		return fmt.Sprintf("%s rule %q", RemoteIgnoreFile, rule.String())
+	}
+	return ""
+}
+
+// readPatternFile returns patterns from given file, one per line. Empty lines
+// and comments are skipped.
+func readPatternFile(path string) ([]string, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var patterns []string
+	for _, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimSuffix(line, "\r")
+		if strings.TrimSpace(line) == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		patterns = append(patterns, line)
+	}
+	return patterns, nil
+}
@@ -0,0 +1,226 @@
+package sync
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseIgnoreRules(t *testing.T) {
+	rules := parseIgnoreRules(`
+# comment
+*.pyc
+/config/
+!keep.pyc
+docs/**/*.md
+\#literal
+trailing
+`)
+
+	assert.Equal(t, []ignoreRule{
+		ignoreRule{pattern: "**/*.pyc"},
+		ignoreRule{pattern: "config", dirOnly: true},
+		ignoreRule{pattern: "**/keep.pyc", negate: true},
+		ignoreRule{pattern: "docs/**/*.md"},
+		ignoreRule{pattern: "**/#literal"},
+		ignoreRule{pattern: "**/trailing"},
+	}, rules)
+}
+
+func TestMatchIgnoreRules(t *testing.T) {
+	rules := parseIgnoreRules(`
+*.pyc
+!keep.pyc
+/config/
+build/
+!build/keep.txt
+`)
+
+	assert.True(t, matchIgnoreRules(rules, "a.pyc", false))
+	assert.True(t, matchIgnoreRules(rules, "foo/bar/a.pyc", false))
+	assert.False(t, matchIgnoreRules(rules, "foo/keep.pyc", false))
+	assert.False(t, matchIgnoreRules(rules, "foo/a.py", false))
+
+	// anchored dir only pattern
+	assert.True(t, matchIgnoreRules(rules, "config/", true))
+	assert.True(t, matchIgnoreRules(rules, "config/airflow.cfg", false))
+	assert.False(t, matchIgnoreRules(rules, "config", false))
+	assert.False(t, matchIgnoreRules(rules, "foo/config/airflow.cfg", false))
+
+	// file can not be re-included if parent dir is excluded
+	assert.True(t, matchIgnoreRules(rules, "foo/build/keep.txt", false))
+
+	assert.False(t, matchIgnoreRules(nil, "a.pyc", false))
+}
+
+type MockObjectGetter struct {
+	content string
+	err     error
+}
+
+func (self MockObjectGetter) GetObject(input *s3.GetObjectInput) (*s3.GetObjectOutput, error) {
+	if self.err != nil {
+		return nil, self.err
+	}
+	return &s3.GetObjectOutput{
+		Body: ioutil.NopCloser(strings.NewReader(self.content)),
+	}, nil
+}
+
+func TestLoadRemoteIgnore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	assert.Equal(t, nil, err)
+	defer os.RemoveAll(dir)
+
+	p, err := NewPuller("s3://foo/home", dir)
+	assert.Equal(t, nil, err)
+	p.AddExcludePatterns([]string{"airflow.cfg"})
+
+	err = p.loadRemoteIgnore(MockObjectGetter{content: "*.md\n!README.md\n"}, "foo", "home")
+	assert.Equal(t, nil, err)
+	assert.True(t, p.isPathExcluded("airflow.cfg"))
+	assert.True(t, p.isPathExcluded("dags/notes.md"))
+	assert.False(t, p.isPathExcluded("dags/README.md"))
+
+	p.taskQueue = make(chan DownloadTask, 10)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		// drain queue
+		for _ = range p.taskQueue {
+		}
+		wg.Done()
+	}()
+	p.handlePageList(
+		&s3.ListObjectsV2Output{
+			Contents: []*s3.Object{
+				&s3.Object{
+					Key:  aws.String("home/dags/a.py"),
+					ETag: aws.String("\"1\""),
+				},
+				&s3.Object{
+					Key:  aws.String("home/dags/notes.md"),
+					ETag: aws.String("\"2\""),
+				},
+				&s3.Object{
+					Key:  aws.String("home/README.md"),
+					ETag: aws.String("\"3\""),
+				},
+			},
+		},
+		false,
+		"foo",
+		"home",
+		dir,
+	)
+	close(p.taskQueue)
+	wg.Wait()
+	assert.Equal(t, 2, p.fileListedCnt)
+
+	// rules are cleared when ignore file is removed from remote
+	err = p.loadRemoteIgnore(
+		MockObjectGetter{err: awserr.New(s3.ErrCodeNoSuchKey, "not found", nil)}, "foo", "home")
+	assert.Equal(t, nil, err)
+	assert.False(t, p.isPathExcluded("dags/notes.md"))
+}
+
+func TestSkipRemoteIgnoreObject(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	assert.Equal(t, nil, err)
+	defer os.RemoveAll(dir)
+	// copy downloaded before remote ignore was enabled
+	localCopy := filepath.Join(dir, RemoteIgnoreFile)
+	assert.Equal(t, nil, ioutil.WriteFile(localCopy, []byte("*.md\n"), 0644))
+
+	p, err := NewPuller("s3://foo/home", dir)
+	assert.Equal(t, nil, err)
+	p.RemoteIgnore = true
+	p.filesToDelete = map[string]bool{localCopy: true}
+	p.taskQueue = make(chan DownloadTask, 10)
+	p.handlePageList(
+		&s3.ListObjectsV2Output{
+			Contents: []*s3.Object{
+				&s3.Object{Key: aws.String("home/" + RemoteIgnoreFile), ETag: aws.String("\"1\"")},
+				&s3.Object{Key: aws.String("home/dags/" + RemoteIgnoreFile), ETag: aws.String("\"2\"")},
+			},
+		},
+		true,
+		"foo",
+		"home",
+		dir,
+	)
+	close(p.taskQueue)
+
+	pulled := []string{}
+	for task := range p.taskQueue {
+		pulled = append(pulled, task.UidKey)
+	}
+	// only the ignore file at the root of the prefix is read by objinsync
+	assert.Equal(t, []string{"dags/" + RemoteIgnoreFile}, pulled)
+	assert.Equal(t, map[string]bool{localCopy: true}, p.filesToDelete)
+}
+
+func TestWalkAndIgnoreRules(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	assert.Equal(t, nil, err)
+	defer os.RemoveAll(dir)
+
+	logsDir := filepath.Join(dir, "logs")
+	os.MkdirAll(logsDir, os.ModePerm)
+	logFile := filepath.Join(logsDir, "a.log")
+	err = ioutil.WriteFile(logFile, []byte("test"), 0644)
+	assert.Equal(t, nil, err)
+	pyFile := filepath.Join(dir, "a.py")
+	err = ioutil.WriteFile(pyFile, []byte("test"), 0644)
+	assert.Equal(t, nil, err)
+
+	files, err := listAndPruneDir(dir, &pathMatcher{remote: parseIgnoreRules("logs/\n")}, true)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, map[string]bool{pyFile: true}, files)
+}
+
+func TestGitignoreSyntaxExclude(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	assert.Equal(t, nil, err)
+	defer os.RemoveAll(dir)
+
+	excludeFile := filepath.Join(dir, "excludes")
+	err = ioutil.WriteFile(excludeFile, []byte("# local files\n__pycache__/\n\n/airflow.cfg\n*.log\n!keep.log\n"), 0644)
+	assert.Equal(t, nil, err)
+
+	p, err := NewPuller("s3://foo/home", dir)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, nil, p.SetPatternSyntax(PatternSyntaxGitignore))
+	assert.Equal(t, nil, p.AddExcludeFile(excludeFile))
+	assert.NotEqual(t, nil, p.SetPatternSyntax("regex"))
+
+	assert.True(t, p.isPathExcluded("airflow.cfg"))
+	assert.False(t, p.isPathExcluded("dags/airflow.cfg"))
+	assert.True(t, p.isPathExcluded("__pycache__/"))
+	assert.True(t, p.isPathExcluded("dags/__pycache__/a.pyc"))
+	assert.True(t, p.isPathExcluded("dags/a.log"))
+	assert.False(t, p.isPathExcluded("dags/keep.log"))
+	assert.False(t, p.isPathExcluded("dags/a.py"))
+
+	// the same matcher is used for walking local dir
+	cacheDir := filepath.Join(dir, "dags", "__pycache__")
+	os.MkdirAll(cacheDir, os.ModePerm)
+	pycFile := filepath.Join(cacheDir, "a.pyc")
+	err = ioutil.WriteFile(pycFile, []byte("test"), 0644)
+	assert.Equal(t, nil, err)
+	keepFile := filepath.Join(dir, "dags", "keep.log")
+	err = ioutil.WriteFile(keepFile, []byte("test"), 0644)
+	assert.Equal(t, nil, err)
+
+	files, err := listAndPruneDir(dir, p.matcher, true)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, map[string]bool{excludeFile: true, keepFile: true}, files)
+}
@@ -0,0 +1,54 @@
+package sync
+
+import (
+	"sort"
+
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// ListEntry is an object in the remote prefix and whether a pull would
+// include it.
+type ListEntry struct {
+	Path     string `json:"path"`
+	Size     int64  `json:"size"`
+	ETag     string `json:"etag"`
+	Included bool   `json:"included"`
+	// pattern, filter or manifest excluding the object, or why the object is
+	// never pulled as a regular file
+	Reason string `json:"reason,omitempty"`
+}
+
+// List lists the remote prefix applying excludes, filters and manifest the
+// same way as Pull, without comparing with local dir. Entries are sorted by
+// path.
+func (self *Puller) List() ([]ListEntry, error) {
+	self.listOnly = true
+	defer func() {
+		self.listOnly = false
+	}()
+
+	_, list, err := self.prepareListing()
+	if err != nil {
+		return nil, err
+	}
+	return self.list(list)
+}
+
+func (self *Puller) list(list func() error) ([]ListEntry, error) {
+	entries := []ListEntry{}
+	_, err := self.collectTasks(list, func(relPath string, obj *s3.Object, skipReason string) {
+		entry := ListEntry{Path: relPath, Included: skipReason == "", Reason: skipReason}
+		if obj.Size != nil {
+			entry.Size = *obj.Size
+		}
+		if obj.ETag != nil {
+			entry.ETag = *obj.ETag
+		}
+		entries = append(entries, entry)
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].Path < entries[j].Path })
+	return entries, nil
+}
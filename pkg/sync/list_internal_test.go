@@ -0,0 +1,108 @@
+package sync
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestList(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	assert.Equal(t, nil, err)
+	defer os.RemoveAll(dir)
+
+	p, err := NewPuller("s3://foo/home", dir)
+	assert.Equal(t, nil, err)
+	p.AddExcludePatterns([]string{"config/**"})
+	p.matcher.remote = parseIgnoreRules("*.pyc\n")
+	p.MaxSize = 10
+
+	list := func() error {
+		p.handlePageList(
+			&s3.ListObjectsV2Output{
+				Contents: []*s3.Object{
+					&s3.Object{Key: aws.String("home/dags/a.py"), ETag: aws.String("\"1\""), Size: aws.Int64(1)},
+					&s3.Object{Key: aws.String("home/dags/a.pyc"), ETag: aws.String("\"2\""), Size: aws.Int64(2)},
+					&s3.Object{Key: aws.String("home/config/airflow.cfg"), ETag: aws.String("\"3\""), Size: aws.Int64(3)},
+					&s3.Object{
+						Key:          aws.String("home/data.bin"),
+						ETag:         aws.String("\"4\""),
+						Size:         aws.Int64(100),
+						LastModified: aws.Time(time.Now()),
+					},
+				},
+			},
+			true,
+			"foo",
+			"home",
+			dir,
+		)
+		return nil
+	}
+	entries, err := p.list(list)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 4, len(entries))
+	assert.Equal(t, ListEntry{
+		Path: "config/airflow.cfg", Size: 3, ETag: "\"3\"", Reason: "exclude pattern \"config/**\""}, entries[0])
+	assert.Equal(t, ListEntry{Path: "dags/a.py", Size: 1, ETag: "\"1\"", Included: true}, entries[1])
+	assert.Equal(t, ListEntry{
+		Path: "dags/a.pyc", Size: 2, ETag: "\"2\"", Reason: ".objinsyncignore rule \"**/*.pyc\""}, entries[2])
+	assert.Equal(t, false, entries[3].Included)
+	assert.NotEqual(t, "", entries[3].Reason)
+}
+
+func TestListSkippedObjects(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	assert.Equal(t, nil, err)
+	defer os.RemoveAll(dir)
+	outside, err := ioutil.TempDir("", "")
+	assert.Equal(t, nil, err)
+	defer os.RemoveAll(outside)
+
+	p, err := NewPuller("s3://foo/home", dir)
+	assert.Equal(t, nil, err)
+	p.CommitMarker = "_SUCCESS"
+	p.RemoteIgnore = true
+	p.manifest, err = parseManifest([]byte(`{"files": [{"path": "link/a.py"}]}`))
+	assert.Equal(t, nil, err)
+	p.listOnly = true
+
+	// local dir is not looked at when listing
+	assert.Equal(t, nil, os.Symlink(outside, filepath.Join(dir, "link")))
+
+	list := func() error {
+		p.handlePageList(
+			&s3.ListObjectsV2Output{
+				Contents: []*s3.Object{
+					&s3.Object{Key: aws.String("home/link/a.py"), ETag: aws.String("\"1\""), Size: aws.Int64(1)},
+					&s3.Object{Key: aws.String("home/../etc/passwd"), ETag: aws.String("\"2\""), Size: aws.Int64(2)},
+					&s3.Object{Key: aws.String("home/_SUCCESS"), ETag: aws.String("\"3\""), Size: aws.Int64(0)},
+					&s3.Object{Key: aws.String("home/.objinsyncignore"), ETag: aws.String("\"4\""), Size: aws.Int64(4)},
+					&s3.Object{Key: aws.String("home/_manifest.json"), ETag: aws.String("\"5\""), Size: aws.Int64(5)},
+				},
+			},
+			true,
+			"foo",
+			"home",
+			dir,
+		)
+		return nil
+	}
+	entries, err := p.list(list)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 5, len(entries))
+	assert.Equal(t, ListEntry{
+		Path: "../etc/passwd", Size: 2, ETag: "\"2\"",
+		Reason: "rejected: path ../etc/passwd is outside of remote prefix"}, entries[0])
+	assert.Equal(t, ListEntry{
+		Path: ".objinsyncignore", Size: 4, ETag: "\"4\"", Reason: "remote ignore file"}, entries[1])
+	assert.Equal(t, ListEntry{Path: "_SUCCESS", Size: 0, ETag: "\"3\"", Reason: "commit marker"}, entries[2])
+	assert.Equal(t, ListEntry{Path: "_manifest.json", Size: 5, ETag: "\"5\"", Reason: "manifest"}, entries[3])
+	assert.Equal(t, ListEntry{Path: "link/a.py", Size: 1, ETag: "\"1\"", Included: true}, entries[4])
+}
@@ -0,0 +1,282 @@
+package sync
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"go.uber.org/zap"
+)
+
+const (
+	// ManifestFile lists files published under the remote prefix together
+	// with their SHA-256 digests and ETags. When it's signed by the publisher,
+	// signature is stored in ManifestSignatureFile.
+	ManifestFile          = "_manifest.json"
+	ManifestSignatureFile = ManifestFile + ".sig"
+)
+
+type manifestEntry struct {
+	// path relative to the remote prefix
+	Path string `json:"path"`
+	// hex encoded SHA-256 of content
+	SHA256 string `json:"sha256,omitempty"`
+	// ETag, size and last modified time of the object, used in place of
+	// object listing for manifest driven sync
+	ETag         string     `json:"etag,omitempty"`
+	Size         *int64     `json:"size,omitempty"`
+	LastModified *time.Time `json:"last_modified,omitempty"`
+}
+
+type manifest struct {
+	Files []manifestEntry `json:"files"`
+
+	entries map[string]manifestEntry
+}
+
+func parseManifest(data []byte) (*manifest, error) {
+	m := &manifest{}
+	if err := json.Unmarshal(data, m); err != nil {
+		return nil, fmt.Errorf("invalid manifest: %v", err)
+	}
+
+	m.entries = make(map[string]manifestEntry, len(m.Files))
+	for _, entry := range m.Files {
+		if entry.Path == "" {
+			return nil, fmt.Errorf("manifest entry without path")
+		}
+		entry.Path = path.Clean(entry.Path)
+		if entry.SHA256 != "" {
+			digest, err := hex.DecodeString(entry.SHA256)
+			if err != nil || len(digest) != sha256.Size {
+				return nil, fmt.Errorf("invalid sha256 for %s in manifest", entry.Path)
+			}
+			entry.SHA256 = strings.ToLower(entry.SHA256)
+		}
+		if entry.ETag != "" && !strings.HasPrefix(entry.ETag, "\"") {
+			// ETags from object listing are quoted
+			entry.ETag = fmt.Sprintf("%q", entry.ETag)
+		}
+		if _, ok := m.entries[entry.Path]; ok {
+			return nil, fmt.Errorf("duplicated path %s in manifest", entry.Path)
+		}
+		m.entries[entry.Path] = entry
+	}
+	return m, nil
+}
+
+// check makes sure all entries have fields required by the sync mode.
+func (self *manifest) check(requireSHA256 bool, requireETag bool) error {
+	for _, entry := range self.entries {
+		if requireSHA256 && entry.SHA256 == "" {
+			return fmt.Errorf("missing sha256 for %s in manifest", entry.Path)
+		}
+		if requireETag && entry.ETag == "" {
+			return fmt.Errorf("missing etag for %s in manifest", entry.Path)
+		}
+	}
+	return nil
+}
+
+// listObjects converts manifest entries into an object listing of the remote
+// prefix.
+func (self *manifest) listObjects(remoteDirPath string) *s3.ListObjectsV2Output {
+	page := &s3.ListObjectsV2Output{}
+	for _, entry := range self.Files {
+		entry = self.entries[path.Clean(entry.Path)]
+		page.Contents = append(page.Contents, &s3.Object{
+			Key:          aws.String(path.Join(remoteDirPath, entry.Path)),
+			ETag:         aws.String(entry.ETag),
+			Size:         entry.Size,
+			LastModified: entry.LastModified,
+		})
+	}
+	return page
+}
+
+// isManifestObject reports whether given path relative to the remote prefix
+// is the manifest or its signature.
+func isManifestObject(relPath string) bool {
+	return relPath == ManifestFile || relPath == ManifestSignatureFile
+}
+
+// ParseManifestPublicKey parses PEM encoded ed25519 or ECDSA (e.g. cosign)
+// public key used to verify manifest signatures.
+func ParseManifestPublicKey(data []byte) (crypto.PublicKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("manifest public key is not PEM encoded")
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("invalid manifest public key: %v", err)
+	}
+	switch key.(type) {
+	case ed25519.PublicKey, *ecdsa.PublicKey:
+		return key, nil
+	default:
+		return nil, fmt.Errorf("unsupported manifest public key type %T", key)
+	}
+}
+
+// SetManifestPublicKey makes every pull verify the signed manifest from the
+// remote prefix and only apply changes if all downloads match it.
+func (self *Puller) SetManifestPublicKey(key crypto.PublicKey) error {
+	switch key.(type) {
+	case ed25519.PublicKey, *ecdsa.PublicKey:
+	default:
+		return fmt.Errorf("unsupported manifest public key type %T", key)
+	}
+	self.manifestKey = key
+	return nil
+}
+
+// verifyManifestSignature checks raw or base64 encoded signature of manifest
+// content. ECDSA signatures are expected over SHA-256 of content, which is
+// what `cosign sign-blob` produces.
+func verifyManifestSignature(key crypto.PublicKey, data []byte, sig []byte) error {
+	if decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(sig))); err == nil {
+		sig = decoded
+	}
+
+	valid := false
+	switch key := key.(type) {
+	case ed25519.PublicKey:
+		valid = ed25519.Verify(key, data, sig)
+	case *ecdsa.PublicKey:
+		digest := sha256.Sum256(data)
+		valid = ecdsa.VerifyASN1(key, digest[:], sig)
+	default:
+		return fmt.Errorf("unsupported manifest public key type %T", key)
+	}
+	if !valid {
+		return fmt.Errorf("invalid manifest signature")
+	}
+	return nil
+}
+
+// loadManifest fetches manifest and its signature from the remote prefix and
+// verifies the signature if manifest public key is set. Manifest is fetched
+// conditionally, previous manifest is kept if it hasn't changed and dropped
+// if the new one can't be loaded.
+func (self *Puller) loadManifest(svc GenericObjectGetter, bucket string, remoteDirPath string) error {
+	l := zap.S()
+
+	key := path.Join(remoteDirPath, ManifestFile)
+	input := &s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	}
+	self.setSSECustomerKeyOnGet(input)
+	if self.manifest != nil && self.manifestETag != "" {
+		input.IfNoneMatch = aws.String(self.manifestETag)
+	}
+
+	m, etag, err := self.fetchManifest(svc, input)
+	if err != nil {
+		if isNotModifiedErr(err) {
+			l.Debugf("Manifest s3://%s/%s not modified", bucket, key)
+			return nil
+		}
+		self.manifest = nil
+		self.manifestETag = ""
+		return fmt.Errorf("failed to load s3://%s/%s: %v", bucket, key, err)
+	}
+
+	l.Debugf("Loaded manifest with %d files from s3://%s/%s", len(m.entries), bucket, key)
+	self.manifest = m
+	self.manifestETag = etag
+	return nil
+}
+
+func (self *Puller) fetchManifest(svc GenericObjectGetter, input *s3.GetObjectInput) (*manifest, string, error) {
+	resp, err := svc.GetObject(input)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if self.manifestKey != nil {
+		sigKey := path.Join(path.Dir(*input.Key), ManifestSignatureFile)
+		sig, err := self.getObjectContent(svc, *input.Bucket, sigKey)
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to fetch signature: %v", err)
+		}
+		if err := verifyManifestSignature(self.manifestKey, data, sig); err != nil {
+			return nil, "", err
+		}
+	}
+
+	m, err := parseManifest(data)
+	if err != nil {
+		return nil, "", err
+	}
+	if err := m.check(self.manifestKey != nil, self.ManifestSync); err != nil {
+		return nil, "", err
+	}
+	return m, aws.StringValue(resp.ETag), nil
+}
+
+func (self *Puller) getObjectContent(svc GenericObjectGetter, bucket string, key string) ([]byte, error) {
+	input := &s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	}
+	self.setSSECustomerKeyOnGet(input)
+	resp, err := svc.GetObject(input)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return ioutil.ReadAll(resp.Body)
+}
+
+// checkManifestDigest compares hex encoded SHA-256 of downloaded content with
+// the one from manifest.
+func (self *Puller) checkManifestDigest(task DownloadTask, digest string) error {
+	if task.ManifestSHA256 == "" {
+		return nil
+	}
+	if digest != task.ManifestSHA256 {
+		return fmt.Errorf("sha256 mismatch, expected %s, got %s", task.ManifestSHA256, digest)
+	}
+	return nil
+}
+
+func sha256Hex(data []byte) string {
+	digest := sha256.Sum256(data)
+	return hex.EncodeToString(digest[:])
+}
+
+func sha256HexFromLocalPath(localPath string) (string, error) {
+	f, err := os.Open(localPath)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,293 @@
+package sync
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/stretchr/testify/assert"
+)
+
+type MapObjectGetter struct {
+	objects map[string]string
+}
+
+func (self MapObjectGetter) GetObject(input *s3.GetObjectInput) (*s3.GetObjectOutput, error) {
+	content, ok := self.objects[*input.Key]
+	if !ok {
+		return nil, awserr.New(s3.ErrCodeNoSuchKey, "not found", nil)
+	}
+	return &s3.GetObjectOutput{
+		Body: ioutil.NopCloser(strings.NewReader(content)),
+	}, nil
+}
+
+func encodePublicKeyPEM(t *testing.T, key interface{}) []byte {
+	der, err := x509.MarshalPKIXPublicKey(key)
+	assert.Equal(t, nil, err)
+	return pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+}
+
+func TestParseManifest(t *testing.T) {
+	m, err := parseManifest([]byte(`{"files": [{"path": "dags/a.py", "sha256": "` +
+		strings.ToUpper(sha256Hex([]byte("a"))) + `"}]}`))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, sha256Hex([]byte("a")), m.entries["dags/a.py"].SHA256)
+
+	_, err = parseManifest([]byte(`{"files": [{"path": "a.py", "sha256": "abc"}]}`))
+	assert.NotEqual(t, nil, err)
+
+	_, err = parseManifest([]byte(`{"files": [{"path": "", "sha256": "` + sha256Hex(nil) + `"}]}`))
+	assert.NotEqual(t, nil, err)
+
+	_, err = parseManifest([]byte(`{"files": [` +
+		`{"path": "a.py", "sha256": "` + sha256Hex(nil) + `"},` +
+		`{"path": "a.py", "sha256": "` + sha256Hex(nil) + `"}]}`))
+	assert.NotEqual(t, nil, err)
+
+	_, err = parseManifest([]byte(`not json`))
+	assert.NotEqual(t, nil, err)
+}
+
+func TestVerifyManifestSignature(t *testing.T) {
+	data := []byte(`{"files": []}`)
+
+	edPub, edPriv, err := ed25519.GenerateKey(rand.Reader)
+	assert.Equal(t, nil, err)
+	key, err := ParseManifestPublicKey(encodePublicKeyPEM(t, edPub))
+	assert.Equal(t, nil, err)
+	sig := ed25519.Sign(edPriv, data)
+	assert.Equal(t, nil, verifyManifestSignature(key, data, sig))
+	assert.Equal(t, nil, verifyManifestSignature(
+		key, data, []byte(base64.StdEncoding.EncodeToString(sig)+"\n")))
+	assert.NotEqual(t, nil, verifyManifestSignature(key, []byte(`{"files": [1]}`), sig))
+
+	ecPriv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Equal(t, nil, err)
+	key, err = ParseManifestPublicKey(encodePublicKeyPEM(t, &ecPriv.PublicKey))
+	assert.Equal(t, nil, err)
+	digest := sha256.Sum256(data)
+	sig, err = ecdsa.SignASN1(rand.Reader, ecPriv, digest[:])
+	assert.Equal(t, nil, err)
+	assert.Equal(t, nil, verifyManifestSignature(
+		key, data, []byte(base64.StdEncoding.EncodeToString(sig))))
+	assert.NotEqual(t, nil, verifyManifestSignature(key, []byte(`{}`), sig))
+
+	_, err = ParseManifestPublicKey([]byte("not a key"))
+	assert.NotEqual(t, nil, err)
+}
+
+func TestLoadManifest(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	assert.Equal(t, nil, err)
+	defer os.RemoveAll(dir)
+
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	assert.Equal(t, nil, err)
+	p, err := NewPuller("s3://foo/home", dir)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, nil, p.SetManifestPublicKey(pub))
+
+	data := `{"files": [{"path": "a.py", "sha256": "` + sha256Hex([]byte("a")) + `"}]}`
+	objects := map[string]string{
+		"home/_manifest.json":     data,
+		"home/_manifest.json.sig": base64.StdEncoding.EncodeToString(ed25519.Sign(priv, []byte(data))),
+	}
+	assert.Equal(t, nil, p.loadManifest(MapObjectGetter{objects}, "foo", "home"))
+	assert.Equal(t, 1, len(p.manifest.entries))
+
+	// manifest tampered after signing
+	objects["home/_manifest.json"] = `{"files": []}`
+	assert.NotEqual(t, nil, p.loadManifest(MapObjectGetter{objects}, "foo", "home"))
+	assert.Equal(t, (*manifest)(nil), p.manifest)
+
+	delete(objects, "home/_manifest.json.sig")
+	assert.NotEqual(t, nil, p.loadManifest(MapObjectGetter{objects}, "foo", "home"))
+}
+
+func TestManifestStagesDownloads(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	assert.Equal(t, nil, err)
+	defer os.RemoveAll(dir)
+
+	p, err := NewPuller("s3://foo/home", dir)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, nil, p.SetupWorkingDir())
+	p.manifest, err = parseManifest([]byte(`{"files": [` +
+		`{"path": "a.py", "sha256": "` + sha256Hex([]byte("a")) + `"},` +
+		`{"path": "b.py", "sha256": "` + sha256Hex([]byte("b")) + `"}]}`))
+	assert.Equal(t, nil, err)
+	p.filesToDelete = map[string]bool{filepath.Join(dir, "c.py"): true}
+
+	p.taskQueue = make(chan DownloadTask, 10)
+	p.handlePageList(
+		&s3.ListObjectsV2Output{
+			Contents: []*s3.Object{
+				&s3.Object{Key: aws.String("home/_manifest.json"), ETag: aws.String("1")},
+				&s3.Object{Key: aws.String("home/_manifest.json.sig"), ETag: aws.String("2")},
+				&s3.Object{Key: aws.String("home/a.py"), ETag: aws.String("3")},
+				&s3.Object{Key: aws.String("home/b.py"), ETag: aws.String("4")},
+				&s3.Object{Key: aws.String("home/c.py"), ETag: aws.String("5")},
+			},
+		},
+		false,
+		"foo",
+		"home",
+		dir,
+	)
+	close(p.taskQueue)
+
+	tasks := []DownloadTask{}
+	for task := range p.taskQueue {
+		tasks = append(tasks, task)
+	}
+	assert.Equal(t, 2, len(tasks))
+	assert.Equal(t, sha256Hex([]byte("a")), tasks[0].ManifestSHA256)
+	// unlisted object is skipped and its local copy stays in delete list
+	assert.Equal(t, 1, p.fileSkippedCnt)
+	assert.Equal(t, map[string]bool{filepath.Join(dir, "c.py"): true}, p.filesToDelete)
+
+	p.errMsgQueue = make(chan string, 30)
+	p.downloadHandler(tasks[0], MockDownloader{content: "a"})
+	// content doesn't match manifest
+	p.downloadHandler(tasks[1], MockDownloader{content: "evil"})
+	close(p.errMsgQueue)
+
+	messages := []string{}
+	for msg := range p.errMsgQueue {
+		messages = append(messages, msg)
+	}
+	assert.Equal(t, 1, len(messages))
+	assert.True(t, strings.HasPrefix(messages[0], "Manifest check failed for s3://foo/home/b.py"))
+
+	// verified download is staged without touching local dir
+	assert.Equal(t, 1, len(p.staged))
+	_, err = os.Stat(filepath.Join(dir, "a.py"))
+	assert.True(t, os.IsNotExist(err))
+	assert.Equal(t, 0, len(p.uidCache))
+
+	assert.Equal(t, nil, p.installDownload(p.staged[0].task, p.staged[0].tmpPath))
+	content, err := ioutil.ReadFile(filepath.Join(dir, "a.py"))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "a", string(content))
+	assert.Equal(t, "3", p.uidCache["a.py"])
+}
+
+// ConditionalObjectGetter serves objects with ETags and honors IfNoneMatch.
+type ConditionalObjectGetter struct {
+	MapObjectGetter
+	etag  string
+	calls int
+}
+
+func (self *ConditionalObjectGetter) GetObject(input *s3.GetObjectInput) (*s3.GetObjectOutput, error) {
+	self.calls += 1
+	if input.IfNoneMatch != nil && *input.IfNoneMatch == self.etag {
+		return nil, awserr.NewRequestFailure(awserr.New("NotModified", "Not Modified", nil), 304, "")
+	}
+	resp, err := self.MapObjectGetter.GetObject(input)
+	if err == nil {
+		resp.ETag = aws.String(self.etag)
+	}
+	return resp, err
+}
+
+func TestManifestListObjects(t *testing.T) {
+	m, err := parseManifest([]byte(`{"files": [
+		{"path": "dags/a.py", "etag": "abc", "size": 10, "last_modified": "2023-01-02T03:04:05Z"},
+		{"path": "./b.py", "etag": "\"def\""}
+	]}`))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, nil, m.check(false, true))
+	assert.NotEqual(t, nil, m.check(true, true))
+
+	page := m.listObjects("home")
+	assert.Equal(t, 2, len(page.Contents))
+	assert.Equal(t, "home/dags/a.py", *page.Contents[0].Key)
+	assert.Equal(t, "\"abc\"", *page.Contents[0].ETag)
+	assert.Equal(t, int64(10), *page.Contents[0].Size)
+	assert.Equal(t, "2023-01-02T03:04:05Z", page.Contents[0].LastModified.Format(time.RFC3339))
+	assert.Equal(t, "home/b.py", *page.Contents[1].Key)
+	assert.Equal(t, "\"def\"", *page.Contents[1].ETag)
+	assert.Equal(t, (*int64)(nil), page.Contents[1].Size)
+}
+
+func TestLoadManifestNotModified(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	assert.Equal(t, nil, err)
+	defer os.RemoveAll(dir)
+
+	p, err := NewPuller("s3://foo/home", dir)
+	assert.Equal(t, nil, err)
+	p.ManifestSync = true
+
+	getter := &ConditionalObjectGetter{
+		MapObjectGetter: MapObjectGetter{map[string]string{
+			"home/_manifest.json": `{"files": [{"path": "a.py", "etag": "1"}]}`,
+		}},
+		etag: "\"m1\"",
+	}
+	assert.Equal(t, nil, p.loadManifest(getter, "foo", "home"))
+	loaded := p.manifest
+	assert.Equal(t, "\"m1\"", p.manifestETag)
+
+	// unchanged manifest is reused
+	assert.Equal(t, nil, p.loadManifest(getter, "foo", "home"))
+	assert.Equal(t, loaded, p.manifest)
+	assert.Equal(t, 2, getter.calls)
+
+	getter.etag = "\"m2\""
+	getter.objects["home/_manifest.json"] = `{"files": [{"path": "b.py", "etag": "2"}]}`
+	assert.Equal(t, nil, p.loadManifest(getter, "foo", "home"))
+	assert.Equal(t, "\"2\"", p.manifest.entries["b.py"].ETag)
+
+	// etag is required to sync from manifest
+	getter.etag = "\"m3\""
+	getter.objects["home/_manifest.json"] = `{"files": [{"path": "b.py"}]}`
+	assert.NotEqual(t, nil, p.loadManifest(getter, "foo", "home"))
+	assert.Equal(t, (*manifest)(nil), p.manifest)
+}
+
+func TestManifestSyncDownloadsListedVersion(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	assert.Equal(t, nil, err)
+	defer os.RemoveAll(dir)
+
+	p, err := NewPuller("s3://foo/home", dir)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, nil, p.SetupWorkingDir())
+	p.ManifestSync = true
+	p.manifest, err = parseManifest([]byte(`{"files": [{"path": "a.py", "etag": "1"}]}`))
+	assert.Equal(t, nil, err)
+
+	p.taskQueue = make(chan DownloadTask, 10)
+	p.handlePageList(p.manifest.listObjects("home"), true, "foo", "home", dir)
+	close(p.taskQueue)
+	task := <-p.taskQueue
+	assert.Equal(t, "\"1\"", task.ManifestETag)
+
+	p.errMsgQueue = make(chan string, 30)
+	downloader := &RecordingDownloader{MockDownloader: MockDownloader{content: "a"}}
+	p.downloadHandler(task, downloader)
+	close(p.errMsgQueue)
+	for msg := range p.errMsgQueue {
+		assert.Fail(t, msg)
+	}
+	assert.Equal(t, 1, len(downloader.getInputs))
+	assert.Equal(t, "\"1\"", *downloader.getInputs[0].IfMatch)
+	assert.Equal(t, 1, len(p.staged))
+}
@@ -0,0 +1,120 @@
+package sync
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	// modification time in seconds since epoch, as written by s3fs and rclone
+	metaKeyMtime = "mtime"
+	// unix file mode, see parseModeMetadata for supported formats
+	metaKeyMode = "mode"
+	// numeric owner and group ids
+	metaKeyUid = "uid"
+	metaKeyGid = "gid"
+)
+
+// objectMetadata looks up user metadata (x-amz-meta-*) by name. The SDK
+// canonicalizes metadata keys, so lookup is case insensitive.
+func objectMetadata(meta map[string]*string, name string) (string, bool) {
+	for k, v := range meta {
+		if strings.EqualFold(k, name) && v != nil {
+			return *v, true
+		}
+	}
+	return "", false
+}
+
+// parseMtimeMetadata parses modification time stored in object metadata,
+// either as (fractional) seconds since epoch or in RFC3339 format.
+func parseMtimeMetadata(val string) (time.Time, error) {
+	val = strings.TrimSpace(val)
+	if secs, err := strconv.ParseFloat(val, 64); err == nil {
+		whole, frac := math.Modf(secs)
+		return time.Unix(int64(whole), int64(frac*1e9)), nil
+	}
+	if t, err := time.Parse(time.RFC3339Nano, val); err == nil {
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("invalid mtime metadata: %s", val)
+}
+
+// parseModeMetadata parses unix file mode stored in object metadata. s3fs
+// writes st_mode in decimal (e.g. `33188`) while rclone writes it in octal
+// including file type bits (e.g. `100644`). Short values like `755` and values
+// with a leading zero are treated as octal permission bits.
+//
+// Only permission bits are returned, setuid, setgid and sticky bits from
+// remote objects are never applied.
+func parseModeMetadata(val string) (os.FileMode, error) {
+	val = strings.TrimSpace(val)
+	base := 8
+	if len(val) == 5 && !strings.HasPrefix(val, "0") {
+		base = 10
+	}
+	mode, err := strconv.ParseUint(strings.TrimPrefix(val, "0o"), base, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid mode metadata: %s", val)
+	}
+	return os.FileMode(mode) & os.ModePerm, nil
+}
+
+// parseIdMetadata parses uid or gid stored in object metadata, -1 is returned
+// when the value is not set.
+func parseIdMetadata(meta map[string]*string, name string) (int, error) {
+	val, ok := objectMetadata(meta, name)
+	if !ok {
+		return -1, nil
+	}
+	id, err := strconv.Atoi(strings.TrimSpace(val))
+	if err != nil || id < 0 {
+		return -1, fmt.Errorf("invalid %s metadata: %s", name, val)
+	}
+	return id, nil
+}
+
+// applyPermsMetadata sets mode, owner and group of given file from object
+// metadata. Attributes missing from or invalid in metadata are left untouched,
+// so the file keeps default mode and owner of the process. Changing owner is
+// skipped as well if the process isn't allowed to, e.g. when not running as
+// root.
+func applyPermsMetadata(path string, meta map[string]*string) error {
+	l := zap.S()
+
+	if val, ok := objectMetadata(meta, metaKeyMode); ok {
+		mode, err := parseModeMetadata(val)
+		if err != nil {
+			l.Warnf("Using default mode for %s: %v", path, err)
+		} else if err := os.Chmod(path, mode); err != nil {
+			return err
+		}
+	}
+
+	uid, err := parseIdMetadata(meta, metaKeyUid)
+	if err != nil {
+		l.Warnf("Using default owner for %s: %v", path, err)
+	}
+	gid, err := parseIdMetadata(meta, metaKeyGid)
+	if err != nil {
+		l.Warnf("Using default group for %s: %v", path, err)
+	}
+	if uid == -1 && gid == -1 {
+		return nil
+	}
+	if err := os.Lchown(path, uid, gid); err != nil {
+		if errors.Is(err, os.ErrPermission) {
+			l.Warnf("Using default owner and group for %s: %v", path, err)
+			return nil
+		}
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,140 @@
+package sync
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseMtimeMetadata(t *testing.T) {
+	mtime, err := parseMtimeMetadata("1592853839")
+	assert.Equal(t, nil, err)
+	assert.True(t, time.Unix(1592853839, 0).Equal(mtime))
+
+	mtime, err = parseMtimeMetadata("2020-01-02T03:04:05Z")
+	assert.Equal(t, nil, err)
+	assert.True(t, time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC).Equal(mtime))
+
+	_, err = parseMtimeMetadata("yesterday")
+	assert.NotEqual(t, nil, err)
+}
+
+func TestParseModeMetadata(t *testing.T) {
+	for input, expected := range map[string]os.FileMode{
+		"33188":  0644, // s3fs
+		"33261":  0755, // s3fs
+		"100755": 0755, // rclone
+		"755":    0755,
+		"0640":   0640,
+		"4755":   0755,
+	} {
+		mode, err := parseModeMetadata(input)
+		assert.Equal(t, nil, err, input)
+		assert.Equal(t, expected, mode, input)
+	}
+
+	_, err := parseModeMetadata("rwxr-xr-x")
+	assert.NotEqual(t, nil, err)
+}
+
+func TestDownloadWithPermsMetadata(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	assert.Equal(t, nil, err)
+	defer os.RemoveAll(dir)
+
+	p, err := NewPuller("s3://abc/efg", dir)
+	assert.Equal(t, nil, err)
+	p.PreservePerms = true
+	p.SetDefaultFileMode(0600)
+	p.SetDirMode(0750)
+	p.errMsgQueue = make(chan string, 30)
+	assert.Equal(t, nil, p.SetupWorkingDir())
+
+	p.downloadHandler(
+		DownloadTask{
+			Uri:       "s3://abc/efg/scripts/run.sh",
+			LocalPath: filepath.Join(dir, "scripts", "run.sh"),
+			Uid:       "uid",
+		},
+		MockDownloader{metadata: map[string]*string{
+			"Mode": aws.String("100755"),
+			"Uid":  aws.String(strconv.Itoa(os.Getuid())),
+			"Gid":  aws.String(strconv.Itoa(os.Getgid())),
+		}})
+	p.downloadHandler(
+		DownloadTask{
+			Uri:       "s3://abc/efg/scripts/lib.sh",
+			LocalPath: filepath.Join(dir, "scripts", "lib.sh"),
+			Uid:       "uid",
+		},
+		MockDownloader{})
+	close(p.errMsgQueue)
+
+	messages := []string{}
+	for msg := range p.errMsgQueue {
+		messages = append(messages, msg)
+	}
+	assert.Equal(t, []string{}, messages)
+
+	fi, err := os.Stat(filepath.Join(dir, "scripts"))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, os.FileMode(0750), fi.Mode().Perm())
+
+	fi, err = os.Stat(filepath.Join(dir, "scripts", "run.sh"))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, os.FileMode(0755), fi.Mode().Perm())
+
+	// fall back to default file mode
+	fi, err = os.Stat(filepath.Join(dir, "scripts", "lib.sh"))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, os.FileMode(0600), fi.Mode().Perm())
+}
+
+func TestDownloadWithInvalidPermsMetadata(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	assert.Equal(t, nil, err)
+	defer os.RemoveAll(dir)
+
+	p, err := NewPuller("s3://abc/efg", dir)
+	assert.Equal(t, nil, err)
+	p.PreservePerms = true
+	p.SetDefaultFileMode(0600)
+	p.errMsgQueue = make(chan string, 30)
+	assert.Equal(t, nil, p.SetupWorkingDir())
+
+	meta := map[string]*string{
+		"Mode": aws.String("rwxr-xr-x"),
+		"Uid":  aws.String("nobody"),
+		"Gid":  aws.String(strconv.Itoa(os.Getgid())),
+	}
+	if os.Getuid() != 0 {
+		// changing owner fails with EPERM without root
+		meta["Uid"] = aws.String("0")
+	}
+	p.downloadHandler(
+		DownloadTask{
+			Uri:       "s3://abc/efg/run.sh",
+			LocalPath: filepath.Join(dir, "run.sh"),
+			Uid:       "uid",
+			UidKey:    "run.sh",
+		},
+		MockDownloader{content: "echo", metadata: meta})
+	close(p.errMsgQueue)
+
+	messages := []string{}
+	for msg := range p.errMsgQueue {
+		messages = append(messages, msg)
+	}
+	assert.Equal(t, []string{}, messages)
+
+	fi, err := os.Stat(filepath.Join(dir, "run.sh"))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, os.FileMode(0600), fi.Mode().Perm())
+	assert.Equal(t, map[string]string{"run.sh": "uid"}, p.uidCache)
+}
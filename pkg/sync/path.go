@@ -0,0 +1,141 @@
+package sync
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// maximum number of symlinks followed while resolving a path, same as the
+// limit of Linux
+const maxSymlinkHops = 40
+
+// isPathWithinDir lexically checks whether path is dir itself or lives under
+// dir.
+func isPathWithinDir(dir string, path string) bool {
+	absDir, err := filepath.Abs(dir)
+	if err != nil {
+		return false
+	}
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return false
+	}
+	rel, err := filepath.Rel(absDir, absPath)
+	if err != nil {
+		return false
+	}
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// safeLocalPath joins relPath computed from an object key onto localDir and
+// makes sure the result doesn't escape localDir, neither lexically nor through
+// symlinks in its parent dirs. Object keys are controlled by whoever has
+// write access to the bucket, so they can't be trusted.
+func safeLocalPath(localDir string, relPath string) (string, error) {
+	localPath, err := lexicalLocalPath(localDir, relPath)
+	if err != nil {
+		return "", err
+	}
+
+	// symlinks in local dir, e.g. ones created with --symlinks, could still
+	// redirect the write elsewhere. The file itself is replaced by rename, so
+	// only its parent dirs matter.
+	realDir, err := resolvePath(localDir)
+	if err != nil {
+		return "", err
+	}
+	realParent, err := resolvePath(filepath.Dir(localPath))
+	if err != nil {
+		return "", err
+	}
+	if !isPathWithinDir(realDir, realParent) {
+		return "", fmt.Errorf("path %s resolves to %s outside of %s through a symlink", relPath, realParent, localDir)
+	}
+	return localPath, nil
+}
+
+// lexicalLocalPath is safeLocalPath without looking at local dir, for
+// listing objects that are not written locally.
+func lexicalLocalPath(localDir string, relPath string) (string, error) {
+	if strings.Contains(relPath, "\\") {
+		return "", fmt.Errorf("path %s contains backslash", relPath)
+	}
+	if filepath.IsAbs(relPath) {
+		return "", fmt.Errorf("path %s is absolute", relPath)
+	}
+	if relPath == ".." || strings.HasPrefix(relPath, "../") {
+		return "", fmt.Errorf("path %s is outside of remote prefix", relPath)
+	}
+
+	localPath := filepath.Join(localDir, relPath)
+	if !isPathWithinDir(localDir, localPath) {
+		return "", fmt.Errorf("path %s resolves to %s outside of %s", relPath, localPath, localDir)
+	}
+	return localPath, nil
+}
+
+// resolvePath resolves symlinks in path component by component the way the
+// kernel does when following it. Unlike filepath.EvalSymlinks, the path
+// doesn't need to exist, components from the first missing one are appended
+// as they are.
+func resolvePath(path string) (string, error) {
+	// path is not cleaned, .. needs to be applied after resolving symlinks
+	dir := string(filepath.Separator)
+	if !filepath.IsAbs(path) {
+		wd, err := os.Getwd()
+		if err != nil {
+			return "", err
+		}
+		dir = wd
+	}
+	hops := 0
+	return resolvePathFrom(dir, path, &hops)
+}
+
+// resolvePathFrom resolves path relative to dir, which must already be
+// resolved.
+func resolvePathFrom(dir string, path string, hops *int) (string, error) {
+	current := dir
+	if filepath.IsAbs(path) {
+		current = string(filepath.Separator)
+	}
+	for _, part := range strings.Split(filepath.ToSlash(path), "/") {
+		switch part {
+		case "", ".":
+			continue
+		case "..":
+			current = filepath.Dir(current)
+			continue
+		}
+
+		next := filepath.Join(current, part)
+		info, err := os.Lstat(next)
+		if err != nil {
+			if os.IsNotExist(err) {
+				current = next
+				continue
+			}
+			return "", err
+		}
+		if info.Mode()&os.ModeSymlink == 0 {
+			current = next
+			continue
+		}
+
+		*hops += 1
+		if *hops > maxSymlinkHops {
+			return "", fmt.Errorf("too many levels of symlinks in %s", path)
+		}
+		target, err := os.Readlink(next)
+		if err != nil {
+			return "", err
+		}
+		current, err = resolvePathFrom(current, target, hops)
+		if err != nil {
+			return "", err
+		}
+	}
+	return current, nil
+}
@@ -0,0 +1,163 @@
+package sync
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIsPathWithinDir(t *testing.T) {
+	assert.True(t, isPathWithinDir("/data/dags", "/data/dags"))
+	assert.True(t, isPathWithinDir("/data/dags", "/data/dags/a/b.py"))
+	assert.True(t, isPathWithinDir("/data/dags", "/data/dags/a/../b.py"))
+	assert.True(t, isPathWithinDir("/data/dags", "/data/dags/..foo"))
+	assert.False(t, isPathWithinDir("/data/dags", "/data/dags/../b.py"))
+	assert.False(t, isPathWithinDir("/data/dags", "/data/dags2/b.py"))
+	assert.False(t, isPathWithinDir("/data/dags", "/etc/passwd"))
+}
+
+func TestSafeLocalPath(t *testing.T) {
+	localPath, err := safeLocalPath("/data/dags", "a/b.py")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "/data/dags/a/b.py", localPath)
+
+	localPath, err = safeLocalPath("/data/dags", "..b.py")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "/data/dags/..b.py", localPath)
+
+	for _, relPath := range []string{
+		"..",
+		"../etc/cron.d/x",
+		"a/../../etc/cron.d/x",
+		"/etc/passwd",
+		"..\\..\\etc\\passwd",
+		"a\\b.py",
+	} {
+		_, err := safeLocalPath("/data/dags", relPath)
+		assert.NotEqual(t, nil, err, relPath)
+	}
+}
+
+func TestRejectUnsafeObjectKeys(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	assert.Equal(t, nil, err)
+	defer os.RemoveAll(dir)
+
+	p, err := NewPuller("s3://foo/home/dags", dir)
+	assert.Equal(t, nil, err)
+	p.taskQueue = make(chan DownloadTask, 10)
+
+	var tasks []DownloadTask
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		for task := range p.taskQueue {
+			tasks = append(tasks, task)
+		}
+		wg.Done()
+	}()
+
+	p.handlePageList(
+		&s3.ListObjectsV2Output{
+			Contents: []*s3.Object{
+				&s3.Object{
+					Key:  aws.String("home/dags/a.py"),
+					ETag: aws.String("\"1\""),
+				},
+				&s3.Object{
+					Key:  aws.String("home/dags/../../etc/cron.d/x"),
+					ETag: aws.String("\"2\""),
+				},
+				&s3.Object{
+					Key:  aws.String("home/dags_backup/b.py"),
+					ETag: aws.String("\"3\""),
+				},
+				&s3.Object{
+					Key:  aws.String("home/dags/..\\..\\x.py"),
+					ETag: aws.String("\"4\""),
+				},
+				&s3.Object{
+					Key:  aws.String("/etc/passwd"),
+					ETag: aws.String("\"5\""),
+				},
+			},
+		},
+		false,
+		"foo",
+		"home/dags",
+		dir,
+	)
+	close(p.taskQueue)
+	wg.Wait()
+
+	assert.Equal(t, 1, len(tasks))
+	assert.Equal(t, filepath.Join(dir, "a.py"), tasks[0].LocalPath)
+	assert.Equal(t, 1, p.fileListedCnt)
+	assert.Equal(t, 4, p.fileRejectedCnt)
+}
+
+func TestResolvePath(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	assert.Equal(t, nil, err)
+	defer os.RemoveAll(dir)
+	dir, err = filepath.EvalSymlinks(dir)
+	assert.Equal(t, nil, err)
+
+	assert.Equal(t, nil, os.MkdirAll(filepath.Join(dir, "a", "b"), os.ModePerm))
+	assert.Equal(t, nil, os.Symlink("a/b", filepath.Join(dir, "link")))
+	assert.Equal(t, nil, os.Symlink("loop", filepath.Join(dir, "loop")))
+
+	resolved, err := resolvePath(dir + "/link/../c/d")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, filepath.Join(dir, "a", "c", "d"), resolved)
+
+	_, err = resolvePath(filepath.Join(dir, "loop", "x"))
+	assert.NotEqual(t, nil, err)
+}
+
+func TestRejectObjectKeysUnderEscapingSymlink(t *testing.T) {
+	root, err := ioutil.TempDir("", "")
+	assert.Equal(t, nil, err)
+	defer os.RemoveAll(root)
+	dir := filepath.Join(root, "local")
+	assert.Equal(t, nil, os.MkdirAll(filepath.Join(dir, "deep", "er"), os.ModePerm))
+	assert.Equal(t, nil, os.MkdirAll(filepath.Join(root, "outside"), os.ModePerm))
+	// left by an earlier pull, deep/er/a/esc points to root/outside
+	assert.Equal(t, nil, os.Symlink("../..", filepath.Join(dir, "deep", "er", "a")))
+	assert.Equal(t, nil, os.Symlink("../outside", filepath.Join(dir, "esc")))
+
+	_, err = safeLocalPath(dir, "deep/er/a/esc/x")
+	assert.NotEqual(t, nil, err)
+	localPath, err := safeLocalPath(dir, "deep/er/a/b.py")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, filepath.Join(dir, "deep", "er", "a", "b.py"), localPath)
+	// symlink itself can be replaced
+	_, err = safeLocalPath(dir, "esc")
+	assert.Equal(t, nil, err)
+
+	p, err := NewPuller("s3://foo/home", dir)
+	assert.Equal(t, nil, err)
+	p.Symlinks = true
+	p.taskQueue = make(chan DownloadTask, 10)
+	p.handlePageList(
+		&s3.ListObjectsV2Output{
+			Contents: []*s3.Object{
+				&s3.Object{Key: aws.String("home/deep/er/a/esc/x"), ETag: aws.String("\"1\"")},
+				&s3.Object{Key: aws.String("home/esc/y"), ETag: aws.String("\"2\"")},
+			},
+		},
+		true,
+		"foo",
+		"home",
+		dir,
+	)
+	close(p.taskQueue)
+	assert.Equal(t, 0, len(p.taskQueue))
+	assert.Equal(t, 2, p.fileRejectedCnt)
+}
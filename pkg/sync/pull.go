@@ -1,21 +1,25 @@
 package sync
 
 import (
+	"crypto"
 	"crypto/md5"
 	"encoding/hex"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
+	"path"
 	"path/filepath"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/ec2metadata"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
-	"github.com/bmatcuk/doublestar"
 	"github.com/prometheus/client_golang/prometheus"
 	"go.uber.org/zap"
 )
@@ -41,16 +45,70 @@ var (
 		Name:      "files_deleted",
 		Help:      "Number of files deleted in each pull cycle.",
 	})
+
+	metricsFileSkipped = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "objinsync",
+		Subsystem: "pull",
+		Name:      "files_skipped",
+		Help:      "Number of files skipped by filters, manifest or commit marker in each pull cycle.",
+	})
+
+	metricsFileExtraneous = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "objinsync",
+		Subsystem: "pull",
+		Name:      "files_extraneous",
+		Help:      "Number of local files not present remotely and kept because of no-delete mode in each pull cycle.",
+	})
+
+	metricsFileRejected = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "objinsync",
+		Subsystem: "pull",
+		Name:      "files_rejected",
+		Help:      "Number of objects rejected in each pull cycle because their keys resolve outside of the local directory.",
+	})
 )
 
 func init() {
 	prometheus.MustRegister(metricsFileListed)
 	prometheus.MustRegister(metricsFilePulled)
 	prometheus.MustRegister(metricsFileDeleted)
+	prometheus.MustRegister(metricsFileSkipped)
+	prometheus.MustRegister(metricsFileRejected)
+	prometheus.MustRegister(metricsFileExtraneous)
 }
 
 type GenericDownloader interface {
 	Download(io.WriterAt, *s3.GetObjectInput, ...func(*s3manager.Downloader)) (int64, error)
+	HeadObject(*s3.HeadObjectInput) (*s3.HeadObjectOutput, error)
+}
+
+// s3Downloader pairs s3manager downloader with the S3 client it's built from
+// so workers can fetch object metadata as well.
+type s3Downloader struct {
+	downloader *s3manager.Downloader
+	svc        *s3.S3
+}
+
+func (self *s3Downloader) Download(
+	w io.WriterAt,
+	input *s3.GetObjectInput,
+	options ...func(*s3manager.Downloader),
+) (int64, error) {
+	return self.downloader.Download(w, input, options...)
+}
+
+func (self *s3Downloader) HeadObject(input *s3.HeadObjectInput) (*s3.HeadObjectOutput, error) {
+	return self.svc.HeadObject(input)
+}
+
+type GenericObjectGetter interface {
+	GetObject(*s3.GetObjectInput) (*s3.GetObjectOutput, error)
+}
+
+// stagedDownload is a verified download waiting to be moved in place.
+type stagedDownload struct {
+	task    DownloadTask
+	tmpPath string
 }
 
 type DownloadTask struct {
@@ -59,6 +117,17 @@ type DownloadTask struct {
 	Uid       string
 	// uid key is common suffix between local path and remote uri
 	UidKey string
+	// last modified time and size of the remote object
+	ModTime time.Time
+	Size    int64
+	// object content is the target of a symlink to create at LocalPath
+	RcloneLink bool
+	// hex encoded SHA-256 of content from manifest
+	ManifestSHA256 string
+	// ETag of the object version listed in manifest
+	ManifestETag string
+	// object version to download, empty means latest
+	VersionId string
 }
 
 // parse bucket and key out of remote object URI
@@ -77,6 +146,28 @@ func parseObjectUri(uri string) (string, string, error) {
 	return pathParts[0], pathParts[1], nil
 }
 
+func isNotFoundErr(err error) bool {
+	if aerr, ok := err.(awserr.Error); ok {
+		switch aerr.Code() {
+		case s3.ErrCodeNoSuchKey, "NotFound":
+			return true
+		}
+	}
+	return false
+}
+
+// isNotModifiedErr reports whether a conditional request failed because the
+// object matches the given ETag.
+func isNotModifiedErr(err error) bool {
+	if aerr, ok := err.(awserr.RequestFailure); ok && aerr.StatusCode() == 304 {
+		return true
+	}
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == "NotModified" {
+		return true
+	}
+	return false
+}
+
 func uidKeyFromLocalPath(localDir string, localPath string) (string, error) {
 	return filepath.Rel(localDir, localPath)
 }
@@ -103,12 +194,90 @@ type Puller struct {
 	LocalDir   string
 	DisableSSL bool
 	S3Endpoint string
+	// merge rules from RemoteIgnoreFile in the remote prefix with exclude
+	// patterns on every pull
+	RemoteIgnore bool
+	// derive objects to pull from ManifestFile in the remote prefix instead
+	// of listing it
+	ManifestSync bool
+	// never delete local files or empty directories, local files not present
+	// remotely are only reported
+	NoDelete bool
+	// only apply changes when this object in the remote prefix has changed
+	// since the last applied pull
+	CommitMarker string
+	// pull objects as they existed at AsOf using object versions, zero means
+	// latest versions
+	AsOf time.Time
+	// skip objects larger than MaxSize bytes, 0 means no limit
+	MaxSize int64
+	// skip objects modified less than MinAge ago, 0 means no limit
+	MinAge time.Duration
+	// skip objects modified more than MaxAge ago, 0 means no limit
+	MaxAge time.Duration
+	// set mtime of local files to the mtime metadata or last modified time
+	// of remote objects
+	PreserveMtime bool
+	// set mode, owner and group of local files from object metadata
+	PreservePerms bool
+	// create symlinks from objects with symlink-target metadata or
+	// .rclonelink suffix
+	Symlinks bool
+	// verify downloaded content against MD5 ETag and S3 additional checksums
+	Verify bool
 
 	workingDir  string
 	defaultMode os.FileMode
-	exclude     []string
-	workerCnt   int
-	uidCache    map[string]string
+	dirMode     os.FileMode
+	matcher     *pathMatcher
+	compare     string
+	// raw key and base64 encoded MD5 of key for SSE-C
+	sseCustomerKey    string
+	sseCustomerKeyMD5 string
+	// decrypts envelope encrypted objects when set
+	keyProvider KeyProvider
+	// verifies signature of manifest when set
+	manifestKey crypto.PublicKey
+	// manifest of the current pull and its ETag, downloads are staged while
+	// it's set
+	manifest     *manifest
+	manifestETag string
+	staged       []stagedDownload
+	// id of the commit marker applied by the last successful pull and last
+	// modified time of the marker being applied
+	appliedCommit string
+	commitTime    time.Time
+	// version ids by object key in AsOf mode
+	versionIds map[string]string
+	// previous versions of changed files are kept in historyDir for the last
+	// historyCycles pulls when it's set
+	historyDir    string
+	historyCycles int
+	history       *historyRecorder
+	// deleted files are moved into a directory named trashId under trashDir
+	// when it's set
+	trashDir string
+	trashTTL time.Duration
+	trashId  string
+	// called with objects listed by handlePageList and the reason they were
+	// skipped, empty for objects included in the pull, used to report
+	// objects without pulling
+	onObject func(relPath string, obj *s3.Object, skipReason string)
+	// set by List, object keys are only checked lexically since nothing is
+	// written to local dir
+	listOnly  bool
+	workerCnt int
+	uidCache  map[string]string
+	// drift detection settings and state of local files after they were
+	// synced, guarded by uidLock
+	driftInterval  time.Duration
+	driftCompare   string
+	driftAction    string
+	lastDriftCheck time.Time
+	localStates    map[string]localFileState
+	driftedKeys    map[string]bool
+	// SHA-256 of local files calculated during startup in sha256 compare mode
+	localSums   map[string]string
 	uidLock     *sync.Mutex
 	taskQueue   chan DownloadTask
 	errMsgQueue chan string
@@ -122,9 +291,16 @@ type Puller struct {
 	// entry from the delete list
 	//
 	// 3. at the end of the pull, we delete files from the list
-	filesToDelete map[string]bool
-	fileListedCnt int
-	filePulledCnt int
+	filesToDelete   map[string]bool
+	fileListedCnt   int
+	filePulledCnt   int
+	fileSkippedCnt  int
+	fileRejectedCnt int
+	fileDeletedCnt  int
+	// symlinks rejected by download workers, guarded by uidLock and added to
+	// fileRejectedCnt once downloads finish
+	symlinkRejectedCnt int
+	state              pullState
 }
 
 func (self *Puller) downloadHandler(task DownloadTask, downloader GenericDownloader) {
@@ -144,7 +320,7 @@ func (self *Puller) downloadHandler(task DownloadTask, downloader GenericDownloa
 	// create parent dir if not exists
 	parentDir := filepath.Dir(task.LocalPath)
 	if _, err := os.Stat(parentDir); os.IsNotExist(err) {
-		err = os.MkdirAll(parentDir, os.ModePerm)
+		err = os.MkdirAll(parentDir, self.dirMode)
 		if err != nil {
 			self.errMsgQueue <- fmt.Sprintf(
 				"Failed to create directory %s for %s: %v", parentDir, task.LocalPath, err)
@@ -162,33 +338,241 @@ func (self *Puller) downloadHandler(task DownloadTask, downloader GenericDownloa
 	}
 	defer tmpfile.Close()
 
-	downloader.Download(tmpfile, &s3.GetObjectInput{
-		Bucket: aws.String(bucket),
-		Key:    aws.String(key),
-	})
+	var head *s3.HeadObjectOutput
+	if self.needsObjectMetadata() {
+		headInput := &s3.HeadObjectInput{
+			Bucket: aws.String(bucket),
+			Key:    aws.String(key),
+		}
+		if self.Verify || self.compare == CompareSHA256 {
+			headInput.ChecksumMode = aws.String(s3.ChecksumModeEnabled)
+		}
+		if task.VersionId != "" {
+			headInput.VersionId = aws.String(task.VersionId)
+		}
+		self.setSSECustomerKeyOnHead(headInput)
+		head, err = downloader.HeadObject(headInput)
+		if err != nil {
+			self.errMsgQueue <- fmt.Sprintf("Failed to fetch metadata for %s: %v", task.Uri, err)
+			return
+		}
+	}
 
-	// use rename to make file update atomic
-	err = os.Rename(tmpfilePath, task.LocalPath)
-	if err != nil {
-		self.errMsgQueue <- fmt.Sprintf("Failed to replace file %s for download: %v", task.LocalPath, err)
+	if self.isLocalContentUpToDate(task, head) {
+		l.Debugf("Skipping download of %s, local content is up to date", task.Uri)
+		self.uidLock.Lock()
+		self.uidCache[task.UidKey] = task.Uid
+		self.uidLock.Unlock()
+		self.recordLocalState(task.UidKey, task.LocalPath)
+		return
+	}
+
+	linkTarget := ""
+	if self.Symlinks && head != nil {
+		linkTarget, _ = objectMetadata(head.Metadata, metaKeySymlinkTarget)
+	}
+
+	if linkTarget == "" {
+		input := &s3.GetObjectInput{
+			Bucket: aws.String(bucket),
+			Key:    aws.String(key),
+		}
+		if task.VersionId != "" {
+			input.VersionId = aws.String(task.VersionId)
+		}
+		self.setSSECustomerKeyOnGet(input)
+		var writer io.WriterAt = tmpfile
+		var hashingWriter *hashingWriterAt
+		if self.Verify {
+			input.ChecksumMode = aws.String(s3.ChecksumModeEnabled)
+			// make sure downloaded content matches metadata fetched above
+			input.IfMatch = head.ETag
+			hashingWriter = newHashingWriterAt(tmpfile, newContentHashes())
+			writer = hashingWriter
+		}
+		if task.ManifestETag != "" {
+			// only download the object version listed in manifest
+			input.IfMatch = aws.String(task.ManifestETag)
+		}
+
+		if _, err := downloader.Download(writer, input); err != nil {
+			self.errMsgQueue <- fmt.Sprintf("Failed to download %s: %v", task.Uri, err)
+			return
+		}
+
+		if self.Verify {
+			if err := verifyDownload(tmpfilePath, hashingWriter, head); err != nil {
+				os.Remove(tmpfilePath)
+				self.errMsgQueue <- fmt.Sprintf("Integrity check failed for %s: %v", task.Uri, err)
+				return
+			}
+		}
+
+		// content is verified as stored remotely before decryption
+		if self.keyProvider != nil && isEnvelopeEncrypted(head.Metadata) {
+			if err := decryptFile(tmpfilePath, head.Metadata, self.keyProvider); err != nil {
+				os.Remove(tmpfilePath)
+				self.errMsgQueue <- fmt.Sprintf("Failed to decrypt %s: %v", task.Uri, err)
+				return
+			}
+		}
+
+		if task.ManifestSHA256 != "" {
+			digest, err := sha256HexFromLocalPath(tmpfilePath)
+			if err == nil {
+				err = self.checkManifestDigest(task, digest)
+			}
+			if err != nil {
+				os.Remove(tmpfilePath)
+				self.errMsgQueue <- fmt.Sprintf("Manifest check failed for %s: %v", task.Uri, err)
+				return
+			}
+		}
+
+		if task.RcloneLink {
+			content, err := ioutil.ReadFile(tmpfilePath)
+			if err != nil {
+				self.errMsgQueue <- fmt.Sprintf("Failed to read symlink target for %s: %v", task.Uri, err)
+				return
+			}
+			linkTarget = string(content)
+			if linkTarget == "" {
+				l.Errorf("Skipped symlink %s from %s: empty symlink target", task.LocalPath, task.Uri)
+				return
+			}
+		}
+	}
+
+	if linkTarget != "" {
+		if err := validateSymlinkTarget(self.LocalDir, task.LocalPath, linkTarget); err != nil {
+			l.Errorf("SECURITY: rejected symlink %s from %s: %v", task.LocalPath, task.Uri, err)
+			self.uidLock.Lock()
+			self.symlinkRejectedCnt += 1
+			self.uidLock.Unlock()
+			return
+		}
+		// content of rclone links has already been checked after download
+		if !task.RcloneLink {
+			if err := self.checkManifestDigest(task, sha256Hex([]byte(linkTarget))); err != nil {
+				self.errMsgQueue <- fmt.Sprintf("Manifest check failed for %s: %v", task.Uri, err)
+				return
+			}
+		}
+		if err := createTmpSymlink(tmpfilePath, linkTarget); err != nil {
+			self.errMsgQueue <- fmt.Sprintf("Failed to create symlink %s for download: %v", task.LocalPath, err)
+			return
+		}
+	} else {
+		// file attributes are applied before rename so they are updated
+		// atomically together with the content
+		if err := self.applyFileAttributes(task, tmpfilePath, head); err != nil {
+			self.errMsgQueue <- err.Error()
+			return
+		}
+	}
+
+	if self.manifest != nil {
+		// staged downloads are only moved in place once all downloads of the
+		// cycle succeeded
+		self.uidLock.Lock()
+		self.staged = append(self.staged, stagedDownload{task: task, tmpPath: tmpfilePath})
+		self.uidLock.Unlock()
 		return
 	}
 
+	if err := self.installDownload(task, tmpfilePath); err != nil {
+		self.errMsgQueue <- err.Error()
+	}
+}
+
+// installDownload moves downloaded file in place and records its uid.
+func (self *Puller) installDownload(task DownloadTask, tmpPath string) error {
+	if self.history != nil {
+		if err := self.history.preserveReplaced(task.UidKey, task.LocalPath); err != nil {
+			return fmt.Errorf("Failed to keep history of %s: %v", task.LocalPath, err)
+		}
+	}
+
+	// use rename to make file update atomic
+	if err := os.Rename(tmpPath, task.LocalPath); err != nil {
+		return fmt.Errorf("Failed to replace file %s for download: %v", task.LocalPath, err)
+	}
+
 	// update cache with new object ID
 	self.uidLock.Lock()
-	l.Debugw("Updaing uid cache", "key", task.UidKey, "val", task.Uid)
+	zap.S().Debugw("Updaing uid cache", "key", task.UidKey, "val", task.Uid)
 	self.uidCache[task.UidKey] = task.Uid
 	self.uidLock.Unlock()
+	self.recordLocalState(task.UidKey, task.LocalPath)
+	return nil
+}
+
+func (self *Puller) applyFileAttributes(task DownloadTask, path string, head *s3.HeadObjectOutput) error {
+	l := zap.S()
+
+	if self.PreservePerms {
+		if err := applyPermsMetadata(path, head.Metadata); err != nil {
+			return fmt.Errorf("Failed to set permissions for %s: %v", task.LocalPath, err)
+		}
+	}
+	// size-mtime compare mode relies on local mtime being the same as last
+	// modified time of the object
+	if self.PreserveMtime || self.compare == CompareSizeMtime {
+		mtime := task.ModTime
+		if self.compare == CompareSizeMtime {
+			l.Debugf("Ignoring mtime metadata for %s in size-mtime compare mode", task.Uri)
+		} else if val, ok := objectMetadata(head.Metadata, metaKeyMtime); ok {
+			if t, err := parseMtimeMetadata(val); err == nil {
+				mtime = t
+			} else {
+				l.Warnf("Ignoring mtime metadata for %s: %v", task.Uri, err)
+			}
+		}
+		if !mtime.IsZero() {
+			if err := os.Chtimes(path, mtime, mtime); err != nil {
+				return fmt.Errorf("Failed to set mtime for %s: %v", task.LocalPath, err)
+			}
+		}
+	}
+	return nil
+}
+
+// needsObjectMetadata reports whether object metadata needs to be fetched
+// with a HEAD request before download.
+func (self *Puller) needsObjectMetadata() bool {
+	return self.PreserveMtime || self.PreservePerms || self.Symlinks || self.Verify ||
+		self.compare == CompareSHA256 || self.keyProvider != nil
 }
 
 func (self *Puller) isPathExcluded(path string) bool {
-	for _, pattern := range self.exclude {
-		matched, _ := doublestar.Match(pattern, path)
-		if matched {
-			return true
+	return self.matcher.Match(path)
+}
+
+// excludeReason describes the pattern or rule excluding path, empty string
+// means path is not excluded.
+func (self *Puller) excludeReason(path string) string {
+	return self.matcher.explain(path)
+}
+
+// loadRemoteIgnore fetches RemoteIgnoreFile from the remote prefix and
+// replaces remote ignore rules with its content. Rules are cleared if the
+// object doesn't exist.
+func (self *Puller) loadRemoteIgnore(svc GenericObjectGetter, bucket string, remoteDirPath string) error {
+	l := zap.S()
+
+	key := path.Join(remoteDirPath, RemoteIgnoreFile)
+	content, err := self.getObjectContent(svc, bucket, key)
+	if err != nil {
+		if isNotFoundErr(err) {
+			l.Debugf("Remote ignore file s3://%s/%s not found", bucket, key)
+			self.matcher.remote = nil
+			return nil
 		}
+		return err
 	}
-	return false
+	self.matcher.remote = parseIgnoreRules(string(content))
+	l.Debugf("Loaded %d rules from remote ignore file s3://%s/%s", len(self.matcher.remote), bucket, key)
+	return nil
 }
 
 func (self *Puller) handlePageList(
@@ -201,6 +585,7 @@ func (self *Puller) handlePageList(
 	l := zap.S()
 
 	l.Infof("Object list page contains %d objects.", len(page.Contents))
+	now := time.Now()
 	for _, obj := range page.Contents {
 		key := *(obj.Key)
 		// For directories, S3 returns keys with / suffix
@@ -209,24 +594,71 @@ func (self *Puller) handlePageList(
 			continue
 		}
 
-		newUid := *(obj.ETag)
+		newUid := self.remoteUid(obj)
 		uri := fmt.Sprintf("s3://%s/%s", bucket, key)
 		l.Debugf("Processing obj(%s): %s", newUid, uri)
 
 		relPath, err := filepath.Rel(remoteDirPath, key)
 		if err != nil {
-			l.Errorf("skipped %s, %s is not the parent of %s!", uri, remoteDirPath, key)
+			l.Errorf("SECURITY: rejected %s, %s is not the parent of %s!", uri, remoteDirPath, key)
+			self.fileRejectedCnt += 1
+			self.reportObject(key, obj, fmt.Sprintf("rejected: %s is not the parent of %s", remoteDirPath, key))
+			continue
+		}
+		objectPath := relPath
+		rcloneLink := false
+		if self.Symlinks && strings.HasSuffix(relPath, rcloneLinkSuffix) {
+			// local symlink is named after the object without the suffix
+			rcloneLink = true
+			relPath = strings.TrimSuffix(relPath, rcloneLinkSuffix)
+		}
+		var localPath string
+		if self.listOnly {
+			localPath, err = lexicalLocalPath(localDir, relPath)
+		} else {
+			localPath, err = safeLocalPath(localDir, relPath)
+		}
+		if err != nil {
+			l.Errorf("SECURITY: rejected %s: %v", uri, err)
+			self.fileRejectedCnt += 1
+			self.reportObject(relPath, obj, fmt.Sprintf("rejected: %v", err))
 			continue
 		}
 		// ignore file that matches exclude rules
-		shouldSkip := self.isPathExcluded(relPath)
-		if shouldSkip {
-			l.Debugf("skipped %s due to exclude pattern", uri)
+		if excludedBy := self.excludeReason(relPath); excludedBy != "" {
+			l.Debugf("skipped %s due to %s", uri, excludedBy)
+			self.reportObject(relPath, obj, excludedBy)
 			continue
 		}
 
+		if self.isCommitMarker(objectPath) {
+			self.reportObject(relPath, obj, "commit marker")
+			continue
+		}
+		if self.isRemoteIgnoreFile(objectPath) {
+			self.reportObject(relPath, obj, "remote ignore file")
+			continue
+		}
+
+		manifestSHA256 := ""
+		if self.manifest != nil {
+			if isManifestObject(objectPath) {
+				self.reportObject(relPath, obj, "manifest")
+				continue
+			}
+			// local copy of an unlisted object is deleted as it's still in the
+			// delete list
+			entry, ok := self.manifest.entries[objectPath]
+			if !ok {
+				l.Warnf("skipped %s: not listed in manifest", uri)
+				self.fileSkippedCnt += 1
+				self.reportObject(relPath, obj, "not listed in manifest")
+				continue
+			}
+			manifestSHA256 = entry.SHA256
+		}
+
 		// remove file from purge list
-		localPath := filepath.Join(localDir, relPath)
 		l.Debugf("Remove %s from files to delete", localPath)
 		delete(self.filesToDelete, localPath)
 
@@ -237,6 +669,16 @@ func (self *Puller) handlePageList(
 
 		self.fileListedCnt += 1
 
+		// local copy of a filtered object is kept as is, it has already been
+		// removed from the delete list above
+		if reason := self.filterObject(obj, now); reason != "" {
+			l.Infof("skipped %s due to filter: %s", uri, reason)
+			self.fileSkippedCnt += 1
+			self.reportObject(relPath, obj, reason)
+			continue
+		}
+		self.reportObject(relPath, obj, "")
+
 		uidKey := relPath
 		self.uidLock.Lock()
 		oldUid, ok := self.uidCache[uidKey]
@@ -248,20 +690,86 @@ func (self *Puller) handlePageList(
 		}
 
 		self.filePulledCnt += 1
-		self.taskQueue <- DownloadTask{
-			Uri:       uri,
-			LocalPath: localPath,
-			Uid:       newUid,
-			UidKey:    uidKey,
+		task := DownloadTask{
+			Uri:            uri,
+			LocalPath:      localPath,
+			Uid:            newUid,
+			UidKey:         uidKey,
+			RcloneLink:     rcloneLink,
+			ManifestSHA256: manifestSHA256,
 		}
+		if self.ManifestSync {
+			task.ManifestETag = *(obj.ETag)
+		}
+		if self.versionIds != nil {
+			task.VersionId = self.versionIds[key]
+		}
+		if obj.LastModified != nil {
+			task.ModTime = *obj.LastModified
+		}
+		if obj.Size != nil {
+			task.Size = *obj.Size
+		}
+		self.taskQueue <- task
 	}
 	return true
 }
 
+func (self *Puller) reportObject(relPath string, obj *s3.Object, skipReason string) {
+	if self.onObject != nil {
+		self.onObject(relPath, obj, skipReason)
+	}
+}
+
+// listRemote feeds objects to pull into handlePageList, either from object
+// versions current at AsOf, from manifest or by listing the remote prefix.
+func (self *Puller) listRemote(svc *s3.S3, bucket string, remoteDirPath string) error {
+	l := zap.S()
+
+	if !self.AsOf.IsZero() {
+		l.Infow("Listing object versions", "bucket", bucket, "dirpath", remoteDirPath, "asof", self.AsOf)
+		page, err := self.listObjectsAsOf(svc, bucket, remoteDirPath)
+		if err != nil {
+			return err
+		}
+		self.handlePageList(page, true, bucket, remoteDirPath, self.LocalDir)
+		return nil
+	}
+	if self.ManifestSync {
+		l.Infow("Using objects from manifest", "bucket", bucket, "dirpath", remoteDirPath)
+		self.handlePageList(self.manifest.listObjects(remoteDirPath), true, bucket, remoteDirPath, self.LocalDir)
+		return nil
+	}
+
+	l.Infow("Listing objects", "bucket", bucket, "dirpath", remoteDirPath)
+	listParams := &s3.ListObjectsV2Input{
+		Bucket: aws.String(bucket),
+		Prefix: aws.String(remoteDirPath),
+	}
+	return svc.ListObjectsV2Pages(listParams,
+		func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+			return self.handlePageList(page, lastPage, bucket, remoteDirPath, self.LocalDir)
+		})
+}
+
 func (self *Puller) AddExcludePatterns(patterns []string) {
-	for _, pattern := range patterns {
-		self.exclude = append(self.exclude, pattern)
+	self.matcher.addPatterns(patterns)
+}
+
+// AddExcludeFile loads exclude patterns from a file with one pattern per line.
+func (self *Puller) AddExcludeFile(path string) error {
+	patterns, err := readPatternFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read exclude file %s: %v", path, err)
 	}
+	self.AddExcludePatterns(patterns)
+	return nil
+}
+
+// SetPatternSyntax controls how exclude patterns are interpreted, see
+// PatternSyntaxDoublestar and PatternSyntaxGitignore.
+func (self *Puller) SetPatternSyntax(syntax string) error {
+	return self.matcher.setSyntax(syntax)
 }
 
 func (self *Puller) SetupWorkingDir() error {
@@ -277,27 +785,7 @@ func (self *Puller) SetupWorkingDir() error {
 	return nil
 }
 
-func (self *Puller) Pull() string {
-	l := zap.S()
-
-	filesToDelete, err := listAndPruneDir(self.LocalDir, self.exclude)
-	if err != nil {
-		return fmt.Sprintf("Failed to list and prune local dir %s: %v", self.LocalDir, err)
-	}
-	// handlePageList method will remove files existed in remote source from this list
-	self.filesToDelete = filesToDelete
-	defer func() {
-		self.filesToDelete = nil
-	}()
-
-	bucket, remoteDirPath, err := parseObjectUri(self.RemoteUri)
-	if err != nil {
-		return fmt.Sprintf("Invalid remote uri %s: %v", self.RemoteUri, err)
-	}
-
-	self.taskQueue = make(chan DownloadTask, 30)
-	self.errMsgQueue = make(chan string, 30)
-
+func (self *Puller) newS3Client() (*s3.S3, error) {
 	sess := session.Must(session.NewSession())
 
 	region := os.Getenv("AWS_REGION")
@@ -306,7 +794,7 @@ func (self *Puller) Pull() string {
 		metaSvc := ec2metadata.New(sess)
 		region, err = metaSvc.Region()
 		if err != nil {
-			return fmt.Sprintf("Failed to detect AWS region: %v", err)
+			return nil, fmt.Errorf("Failed to detect AWS region: %v", err)
 		}
 	}
 
@@ -318,9 +806,111 @@ func (self *Puller) Pull() string {
 		s3Config.Endpoint = aws.String(self.S3Endpoint)
 		s3Config.S3ForcePathStyle = aws.Bool(true)
 	}
-	svc := s3.New(sess, s3Config)
+	return s3.New(sess, s3Config), nil
+}
 
-	downloader := s3manager.NewDownloaderWithClient(svc)
+// Pull syncs local dir with the remote prefix once and returns an error
+// message if it failed. Progress and result are available from Status.
+func (self *Puller) Pull() string {
+	self.startCycle(time.Now())
+	errMsg := self.pull()
+	self.finishCycle(errMsg, time.Now())
+	return errMsg
+}
+
+func (self *Puller) pull() string {
+	l := zap.S()
+
+	// counters are reported by Status even if the pull stops early
+	self.fileListedCnt = 0
+	self.filePulledCnt = 0
+	self.fileSkippedCnt = 0
+	self.fileRejectedCnt = 0
+	self.fileDeletedCnt = 0
+	self.symlinkRejectedCnt = 0
+
+	bucket, remoteDirPath, err := parseObjectUri(self.RemoteUri)
+	if err != nil {
+		return fmt.Sprintf("Invalid remote uri %s: %v", self.RemoteUri, err)
+	}
+
+	svc, err := self.newS3Client()
+	if err != nil {
+		return err.Error()
+	}
+
+	// drift is reported even while waiting for commit, drifted files are
+	// restored once the pull applies changes
+	self.checkDrift(time.Now())
+	if self.historyDir != "" {
+		self.forgetRolledBack()
+	}
+
+	commitId := ""
+	if self.CommitMarker != "" {
+		id, ready, err := self.checkCommitMarker(svc, bucket, remoteDirPath)
+		if err != nil {
+			return fmt.Sprintf("Failed to check commit marker: %v", err)
+		}
+		if !ready {
+			// leave local tree untouched until the next commit
+			metricsWaitingForCommit.Set(1)
+			self.setWaitingForCommit(true)
+			return ""
+		}
+		metricsWaitingForCommit.Set(0)
+		self.setWaitingForCommit(false)
+		commitId = id
+	}
+	// drifted files need to be removed from uid cache before listing so they
+	// are downloaded again
+	self.restoreDrifted()
+
+	// remote ignore rules need to be loaded before listing local dir so
+	// ignored local files won't be deleted
+	if self.RemoteIgnore {
+		if err := self.loadRemoteIgnore(svc, bucket, remoteDirPath); err != nil {
+			return fmt.Sprintf("Failed to load remote ignore file: %v", err)
+		}
+	}
+
+	if self.manifestKey != nil || self.ManifestSync {
+		if err := self.loadManifest(svc, bucket, remoteDirPath); err != nil {
+			return fmt.Sprintf("Failed to load manifest: %v", err)
+		}
+	}
+	self.staged = nil
+	defer func() {
+		self.staged = nil
+	}()
+
+	if self.historyDir != "" {
+		self.history = newHistoryRecorder(self.historyDir, self.LocalDir, time.Now())
+		defer self.finishHistory()
+	}
+	if self.trashDir != "" {
+		now := time.Now()
+		self.trashId = now.UTC().Format(historyIdFormat)
+		defer self.purgeTrash(now)
+	}
+
+	filesToDelete, err := listAndPruneDir(self.LocalDir, self.matcher, !self.NoDelete)
+	if err != nil {
+		return fmt.Sprintf("Failed to list and prune local dir %s: %v", self.LocalDir, err)
+	}
+	// handlePageList method will remove files existed in remote source from this list
+	self.filesToDelete = filesToDelete
+	defer func() {
+		self.filesToDelete = nil
+	}()
+
+	self.taskQueue = make(chan DownloadTask, 30)
+	self.errMsgQueue = make(chan string, 30)
+
+	downloader := &s3Downloader{
+		downloader: s3manager.NewDownloaderWithClient(svc),
+		svc:        svc,
+	}
 
 	if err := self.SetupWorkingDir(); err != nil {
 		return fmt.Sprintf("Failed to create working directory %s: %v", self.workingDir, err)
@@ -354,65 +944,120 @@ func (self *Puller) Pull() string {
 		errMsgWg.Done()
 	}()
 
-	l.Infow("Listing objects", "bucket", bucket, "dirpath", remoteDirPath)
-	listParams := &s3.ListObjectsV2Input{
-		Bucket: aws.String(bucket),
-		Prefix: aws.String(remoteDirPath),
-	}
-	self.fileListedCnt = 0
-	self.filePulledCnt = 0
-
-	err = svc.ListObjectsV2Pages(listParams,
-		func(page *s3.ListObjectsV2Output, lastPage bool) bool {
-			return self.handlePageList(page, lastPage, bucket, remoteDirPath, self.LocalDir)
-		})
+	err = self.listRemote(svc, bucket, remoteDirPath)
+	self.setPhase(PhaseDownloading)
 	close(self.taskQueue)
 	wg.Wait()
 	close(self.errMsgQueue)
+	self.fileRejectedCnt += self.symlinkRejectedCnt
 
 	metricsFileListed.Set(float64(self.fileListedCnt))
 	metricsFilePulled.Set(float64(self.filePulledCnt))
+	metricsFileSkipped.Set(float64(self.fileSkippedCnt))
+	metricsFileRejected.Set(float64(self.fileRejectedCnt))
 
 	if err != nil {
 		return fmt.Sprintf("Failed to list remote uri %s: %v", self.RemoteUri, err)
 	} else {
 		errMsgWg.Wait()
 
+		if self.manifest != nil {
+			if pullErrMsg != "" {
+				// leave local tree untouched unless all downloads match the
+				// manifest
+				return pullErrMsg
+			}
+			for _, staged := range self.staged {
+				if err := self.installDownload(staged.task, staged.tmpPath); err != nil {
+					return err.Error()
+				}
+			}
+		}
+
+		if self.NoDelete {
+			// files not present remotely are only reported
+			l.Debugf("Local files not present remotely: %s", self.filesToDelete)
+			if len(self.filesToDelete) > 0 {
+				l.Infof("%d local files are not present remotely, not deleting them", len(self.filesToDelete))
+			}
+			metricsFileExtraneous.Set(float64(len(self.filesToDelete)))
+			self.filesToDelete = nil
+		} else {
+			metricsFileExtraneous.Set(0)
+		}
+
 		l.Debugf("Files to delete: %s", self.filesToDelete)
 		metricsFileDeleted.Set(float64(len(self.filesToDelete)))
+		self.fileDeletedCnt = len(self.filesToDelete)
+		self.setPhase(PhaseDeleting)
 		// delete files not exist in remote source
 		for f, _ := range self.filesToDelete {
-			os.Remove(f)
 			uidKey, err := uidKeyFromLocalPath(self.LocalDir, f)
+			self.removeLocalFile(f, uidKey)
 			if err == nil {
 				self.uidLock.Lock()
 				delete(self.uidCache, uidKey)
+				delete(self.localStates, uidKey)
 				self.uidLock.Unlock()
 			}
 		}
 
+		if pullErrMsg == "" && self.CommitMarker != "" {
+			self.appliedCommit = commitId
+		}
 		return pullErrMsg
 	}
 }
 
+// removeLocalFile deletes a local file which no longer exists remotely, it's
+// moved into history or trash instead if either is enabled.
+func (self *Puller) removeLocalFile(path string, relPath string) {
+	if self.history != nil && relPath != "" {
+		err := self.history.moveDeleted(relPath, path)
+		if err == nil {
+			return
+		}
+		zap.S().Errorf("Failed to keep history of %s, deleting it: %v", path, err)
+	} else if self.trashDir != "" && relPath != "" {
+		err := self.moveToTrash(path, relPath)
+		if err == nil {
+			return
+		}
+		zap.S().Errorf("Failed to move %s to trash, deleting it: %v", path, err)
+	}
+	os.Remove(path)
+}
+
 func (self *Puller) PopulateChecksum() {
 	l := zap.S()
 
-	setFileChecksum := func(path string) {
-		f, err := os.Open(path)
+	setFileChecksum := func(path string, info os.FileInfo) {
+		uidKey, err := uidKeyFromLocalPath(self.LocalDir, path)
 		if err != nil {
-			l.Errorf("Invalid file path for checksum calculation: %s, err: %s", path, err)
+			l.Errorf("Failed to calculate uidKey for file: %s under dir: %s, err: %s", path, self.LocalDir, err)
+			return
 		}
-		defer f.Close()
+		// local files are assumed to be in sync on startup
+		self.recordLocalState(uidKey, path)
 
-		h := md5.New()
-		if _, err := io.Copy(h, f); err != nil {
-			l.Errorf("Failed to calculate checksum for file: %s, err: %s", path, err)
+		if self.compare == CompareSizeMtime {
+			self.uidLock.Lock()
+			self.uidCache[uidKey] = sizeMtimeUid(info.Size(), info.ModTime())
+			self.uidLock.Unlock()
+			return
 		}
 
-		uidKey, err := uidKeyFromLocalPath(self.LocalDir, path)
-		if err != nil {
-			l.Errorf("Failed to calculate uidKey for file: %s under dir: %s, err: %s", path, self.LocalDir, err)
+		if self.compare == CompareSHA256 {
+			// object checksums are only fetched for changed objects, so
+			// local checksums are kept separately from the uid cache
+			sum, err := sha256FromLocalPath(path)
+			if err != nil {
+				l.Errorf("Failed to calculate SHA-256: %s", err)
+				return
+			}
+			self.uidLock.Lock()
+			self.localSums[uidKey] = sum
+			self.uidLock.Unlock()
 			return
 		}
 
@@ -454,8 +1099,12 @@ func (self *Puller) PopulateChecksum() {
 			if shouldSkip {
 				return nil
 			}
+			if info.Mode()&os.ModeSymlink != 0 {
+				// symlinks are always recreated during the initial sync
+				return nil
+			}
 
-			setFileChecksum(path)
+			setFileChecksum(path, info)
 		}
 		return nil
 	})
@@ -469,6 +1118,10 @@ func (self *Puller) SetDefaultFileMode(mode os.FileMode) {
 	self.defaultMode = mode
 }
 
+func (self *Puller) SetDirMode(mode os.FileMode) {
+	self.dirMode = mode
+}
+
 func NewPuller(remoteUri string, localDir string) (*Puller, error) {
 	if _, err := os.Stat(localDir); os.IsNotExist(err) {
 		return nil, fmt.Errorf("local directory `%s` does not exist: %v", localDir, err)
@@ -480,8 +1133,15 @@ func NewPuller(remoteUri string, localDir string) (*Puller, error) {
 		DisableSSL:  false,
 		workingDir:  filepath.Join(localDir, ".objinsync"),
 		defaultMode: 0664,
+		dirMode:     os.ModePerm,
+		matcher:     newPathMatcher(nil),
 		workerCnt:   5,
+		compare:     CompareETag,
 		uidCache:    map[string]string{},
+		localSums:   map[string]string{},
+		localStates: map[string]localFileState{},
+		driftedKeys: map[string]bool{},
 		uidLock:     &sync.Mutex{},
+		state:       pullState{status: PullStatus{Phase: PhaseIdle}},
 	}, nil
 }
@@ -7,6 +7,7 @@ import (
 	"path/filepath"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/s3"
@@ -73,7 +74,7 @@ func TestDeleteStaleFile(t *testing.T) {
 	assert.Equal(t, nil, err)
 	assert.Equal(t, nil, p.SetupWorkingDir())
 	p.taskQueue = make(chan DownloadTask, 10)
-	p.filesToDelete, err = listAndPruneDir(dir, nil)
+	p.filesToDelete, err = listAndPruneDir(dir, nil, true)
 	assert.Equal(t, nil, err)
 
 	cnt := 0
@@ -268,10 +269,30 @@ func TestSkipDirectories(t *testing.T) {
 	assert.Equal(t, 1, p.filePulledCnt)
 }
 
-type MockDownloader struct{}
+type MockDownloader struct {
+	content  string
+	metadata map[string]*string
+	etag     string
+	sha256   string
+}
 
 func (self MockDownloader) Download(w io.WriterAt, input *s3.GetObjectInput, options ...func(*s3manager.Downloader)) (int64, error) {
-	return 1, nil
+	if self.content == "" {
+		return 1, nil
+	}
+	n, err := w.WriteAt([]byte(self.content), 0)
+	return int64(n), err
+}
+
+func (self MockDownloader) HeadObject(input *s3.HeadObjectInput) (*s3.HeadObjectOutput, error) {
+	head := &s3.HeadObjectOutput{Metadata: self.metadata}
+	if self.etag != "" {
+		head.ETag = aws.String(self.etag)
+	}
+	if self.sha256 != "" {
+		head.ChecksumSHA256 = aws.String(self.sha256)
+	}
+	return head, nil
 }
 
 func TestNestedPathDownload(t *testing.T) {
@@ -321,3 +342,48 @@ func TestNestedPathDownload(t *testing.T) {
 	assert.Equal(t, true, fi.IsDir())
 	assert.Equal(t, nil, err)
 }
+
+func TestPreserveMtime(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	assert.Equal(t, nil, err)
+	defer os.RemoveAll(dir)
+
+	p, err := NewPuller("s3://abc/efg", dir)
+	assert.Equal(t, nil, err)
+	p.PreserveMtime = true
+	p.errMsgQueue = make(chan string, 30)
+	assert.Equal(t, nil, p.SetupWorkingDir())
+
+	lastModified := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	p.downloadHandler(
+		DownloadTask{
+			Uri:       "s3://abc/efg/a.py",
+			LocalPath: filepath.Join(dir, "a.py"),
+			Uid:       "uid",
+			ModTime:   lastModified,
+		},
+		MockDownloader{})
+	p.downloadHandler(
+		DownloadTask{
+			Uri:       "s3://abc/efg/b.py",
+			LocalPath: filepath.Join(dir, "b.py"),
+			Uid:       "uid",
+			ModTime:   lastModified,
+		},
+		MockDownloader{metadata: map[string]*string{"Mtime": aws.String("1592853839.5")}})
+	close(p.errMsgQueue)
+
+	messages := []string{}
+	for msg := range p.errMsgQueue {
+		messages = append(messages, msg)
+	}
+	assert.Equal(t, []string{}, messages)
+
+	fi, err := os.Stat(filepath.Join(dir, "a.py"))
+	assert.Equal(t, nil, err)
+	assert.True(t, lastModified.Equal(fi.ModTime()))
+
+	fi, err = os.Stat(filepath.Join(dir, "b.py"))
+	assert.Equal(t, nil, err)
+	assert.True(t, time.Unix(1592853839, 5e8).Equal(fi.ModTime()))
+}
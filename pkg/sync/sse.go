@@ -0,0 +1,56 @@
+package sync
+
+import (
+	"crypto/md5"
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+const sseCustomerAlgorithm = "AES256"
+
+// ParseSSECustomerKey parses a 256 bit SSE-C key, either as raw bytes or
+// base64 encoded.
+func ParseSSECustomerKey(data []byte) ([]byte, error) {
+	if len(data) == 32 {
+		return data, nil
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(key) != 32 {
+		return nil, fmt.Errorf("SSE-C key must be 32 bytes, either raw or base64 encoded")
+	}
+	return key, nil
+}
+
+// SetSSECustomerKey makes all GET and HEAD requests use given key for server
+// side encryption with customer provided keys.
+func (self *Puller) SetSSECustomerKey(key []byte) error {
+	if len(key) != 32 {
+		return fmt.Errorf("SSE-C key must be 32 bytes, got %d", len(key))
+	}
+	sum := md5.Sum(key)
+	self.sseCustomerKey = string(key)
+	self.sseCustomerKeyMD5 = base64.StdEncoding.EncodeToString(sum[:])
+	return nil
+}
+
+func (self *Puller) setSSECustomerKeyOnGet(input *s3.GetObjectInput) {
+	if self.sseCustomerKey == "" {
+		return
+	}
+	input.SSECustomerAlgorithm = aws.String(sseCustomerAlgorithm)
+	input.SSECustomerKey = aws.String(self.sseCustomerKey)
+	input.SSECustomerKeyMD5 = aws.String(self.sseCustomerKeyMD5)
+}
+
+func (self *Puller) setSSECustomerKeyOnHead(input *s3.HeadObjectInput) {
+	if self.sseCustomerKey == "" {
+		return
+	}
+	input.SSECustomerAlgorithm = aws.String(sseCustomerAlgorithm)
+	input.SSECustomerKey = aws.String(self.sseCustomerKey)
+	input.SSECustomerKeyMD5 = aws.String(self.sseCustomerKeyMD5)
+}
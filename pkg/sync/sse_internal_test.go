@@ -0,0 +1,88 @@
+package sync
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/base64"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/stretchr/testify/assert"
+)
+
+type RecordingDownloader struct {
+	MockDownloader
+	getInputs  []*s3.GetObjectInput
+	headInputs []*s3.HeadObjectInput
+}
+
+func (self *RecordingDownloader) Download(w io.WriterAt, input *s3.GetObjectInput, options ...func(*s3manager.Downloader)) (int64, error) {
+	self.getInputs = append(self.getInputs, input)
+	return self.MockDownloader.Download(w, input, options...)
+}
+
+func (self *RecordingDownloader) HeadObject(input *s3.HeadObjectInput) (*s3.HeadObjectOutput, error) {
+	self.headInputs = append(self.headInputs, input)
+	return self.MockDownloader.HeadObject(input)
+}
+
+func TestParseSSECustomerKey(t *testing.T) {
+	raw := bytes.Repeat([]byte("k"), 32)
+
+	key, err := ParseSSECustomerKey(raw)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, raw, key)
+
+	key, err = ParseSSECustomerKey([]byte(base64.StdEncoding.EncodeToString(raw) + "\n"))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, raw, key)
+
+	_, err = ParseSSECustomerKey([]byte("short"))
+	assert.NotEqual(t, nil, err)
+}
+
+func TestDownloadWithSSECustomerKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	assert.Equal(t, nil, err)
+	defer os.RemoveAll(dir)
+
+	p, err := NewPuller("s3://abc/efg", dir)
+	assert.Equal(t, nil, err)
+	assert.NotEqual(t, nil, p.SetSSECustomerKey([]byte("short")))
+	assert.Equal(t, nil, p.SetSSECustomerKey(bytes.Repeat([]byte("k"), 32)))
+	assert.Equal(t, nil, p.SetCompareMode(CompareSHA256))
+	p.errMsgQueue = make(chan string, 30)
+	assert.Equal(t, nil, p.SetupWorkingDir())
+
+	sum := md5.Sum(bytes.Repeat([]byte("k"), 32))
+	keyMD5 := base64.StdEncoding.EncodeToString(sum[:])
+
+	downloader := &RecordingDownloader{MockDownloader: MockDownloader{content: "test"}}
+	p.downloadHandler(
+		DownloadTask{
+			Uri:       "s3://abc/efg/a.py",
+			LocalPath: filepath.Join(dir, "a.py"),
+			Uid:       "uid",
+			UidKey:    "a.py",
+		},
+		downloader)
+	close(p.errMsgQueue)
+	for msg := range p.errMsgQueue {
+		assert.Fail(t, msg)
+	}
+
+	assert.Equal(t, 1, len(downloader.headInputs))
+	assert.Equal(t, "AES256", *downloader.headInputs[0].SSECustomerAlgorithm)
+	assert.Equal(t, string(bytes.Repeat([]byte("k"), 32)), *downloader.headInputs[0].SSECustomerKey)
+	assert.Equal(t, keyMD5, *downloader.headInputs[0].SSECustomerKeyMD5)
+
+	assert.Equal(t, 1, len(downloader.getInputs))
+	assert.Equal(t, "AES256", *downloader.getInputs[0].SSECustomerAlgorithm)
+	assert.Equal(t, string(bytes.Repeat([]byte("k"), 32)), *downloader.getInputs[0].SSECustomerKey)
+	assert.Equal(t, keyMD5, *downloader.getInputs[0].SSECustomerKeyMD5)
+}
@@ -0,0 +1,149 @@
+package sync
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	// no pull is running
+	PhaseIdle = "idle"
+	// remote prefix is being listed while changed objects are downloaded
+	PhaseListing = "listing"
+	// listing is done, remaining downloads are being finished
+	PhaseDownloading = "downloading"
+	// local files not present remotely are being deleted
+	PhaseDeleting = "deleting"
+)
+
+// PullStatus describes the running pull and the result of the last one.
+type PullStatus struct {
+	RemoteUri string `json:"remote_uri"`
+	LocalDir  string `json:"local_dir"`
+	Phase     string `json:"phase"`
+	// start of the running pull, zero when idle
+	CycleStart time.Time `json:"cycle_start"`
+
+	LastCycleStart    time.Time `json:"last_cycle_start"`
+	LastCycleEnd      time.Time `json:"last_cycle_end"`
+	LastCycleDuration float64   `json:"last_cycle_duration_seconds"`
+	LastSuccess       time.Time `json:"last_success"`
+	FilesListed       int       `json:"files_listed"`
+	FilesPulled       int       `json:"files_pulled"`
+	FilesDeleted      int       `json:"files_deleted"`
+	FilesSkipped      int       `json:"files_skipped"`
+	FilesRejected     int       `json:"files_rejected"`
+	// last pull found commit marker unchanged and left local dir untouched
+	WaitingForCommit    bool   `json:"waiting_for_commit"`
+	LastError           string `json:"last_error,omitempty"`
+	ConsecutiveFailures int    `json:"consecutive_failures"`
+	// number of local files with known remote uid
+	CacheSize int `json:"cache_size"`
+}
+
+// pullState is updated by Pull and read by Status from other goroutines.
+type pullState struct {
+	status PullStatus
+	lock   sync.Mutex
+}
+
+// Status returns a snapshot of the running pull and the result of the last
+// one.
+func (self *Puller) Status() PullStatus {
+	self.state.lock.Lock()
+	status := self.state.status
+	self.state.lock.Unlock()
+
+	status.RemoteUri = self.RemoteUri
+	status.LocalDir = self.LocalDir
+	self.uidLock.Lock()
+	status.CacheSize = len(self.uidCache)
+	self.uidLock.Unlock()
+	return status
+}
+
+func (self *Puller) setPhase(phase string) {
+	self.state.lock.Lock()
+	self.state.status.Phase = phase
+	self.state.lock.Unlock()
+}
+
+func (self *Puller) setWaitingForCommit(waiting bool) {
+	self.state.lock.Lock()
+	self.state.status.WaitingForCommit = waiting
+	self.state.lock.Unlock()
+}
+
+func (self *Puller) startCycle(now time.Time) {
+	self.state.lock.Lock()
+	self.state.status.Phase = PhaseListing
+	self.state.status.CycleStart = now
+	self.state.lock.Unlock()
+}
+
+// finishCycle records result of the pull started by startCycle, errMsg is
+// the one returned by Pull.
+func (self *Puller) finishCycle(errMsg string, now time.Time) {
+	self.state.lock.Lock()
+	defer self.state.lock.Unlock()
+
+	status := &self.state.status
+	status.LastCycleStart = status.CycleStart
+	status.LastCycleEnd = now
+	status.LastCycleDuration = now.Sub(status.CycleStart).Seconds()
+	status.Phase = PhaseIdle
+	status.CycleStart = time.Time{}
+	status.FilesListed = self.fileListedCnt
+	status.FilesPulled = self.filePulledCnt
+	status.FilesDeleted = self.fileDeletedCnt
+	status.FilesSkipped = self.fileSkippedCnt
+	status.FilesRejected = self.fileRejectedCnt
+	status.LastError = errMsg
+	if errMsg != "" {
+		status.ConsecutiveFailures += 1
+		return
+	}
+	status.ConsecutiveFailures = 0
+	// local dir hasn't been synced yet if the first commit is still awaited
+	if !status.WaitingForCommit || self.appliedCommit != "" {
+		status.LastSuccess = now
+	}
+}
+
+// CheckLive returns an error if the pull loop looks wedged, either because
+// the running pull takes longer than maxCycleDuration or because no pull has
+// started within interval after the last one ended. Checks are disabled if
+// maxCycleDuration is 0.
+func (self PullStatus) CheckLive(now time.Time, interval time.Duration, maxCycleDuration time.Duration) error {
+	if maxCycleDuration <= 0 {
+		return nil
+	}
+	if !self.CycleStart.IsZero() {
+		if running := now.Sub(self.CycleStart); running > maxCycleDuration {
+			return fmt.Errorf("pull has been running for %v", running)
+		}
+		return nil
+	}
+	if !self.LastCycleEnd.IsZero() {
+		if idle := now.Sub(self.LastCycleEnd); idle > interval+maxCycleDuration {
+			return fmt.Errorf("no pull started for %v", idle)
+		}
+	}
+	return nil
+}
+
+// CheckReady returns an error if local dir hasn't been synced yet, or if the
+// last successful pull is older than maxStaleness. Staleness is not checked
+// if maxStaleness is 0.
+func (self PullStatus) CheckReady(now time.Time, maxStaleness time.Duration) error {
+	if self.LastSuccess.IsZero() {
+		return fmt.Errorf("initial pull not finished")
+	}
+	if maxStaleness > 0 {
+		if age := now.Sub(self.LastSuccess); age > maxStaleness {
+			return fmt.Errorf("last successful pull finished %v ago", age)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,115 @@
+package sync
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPullStatus(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	assert.Equal(t, nil, err)
+	defer os.RemoveAll(dir)
+
+	p, err := NewPuller("s3://foo/home", dir)
+	assert.Equal(t, nil, err)
+	status := p.Status()
+	assert.Equal(t, "s3://foo/home", status.RemoteUri)
+	assert.Equal(t, dir, status.LocalDir)
+	assert.Equal(t, PhaseIdle, status.Phase)
+
+	start := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	p.startCycle(start)
+	assert.Equal(t, PhaseListing, p.Status().Phase)
+	assert.Equal(t, start, p.Status().CycleStart)
+	p.fileListedCnt = 3
+	p.filePulledCnt = 2
+	p.fileDeletedCnt = 1
+	p.uidCache["a.py"] = "\"1\""
+	p.finishCycle("", start.Add(2*time.Second))
+
+	status = p.Status()
+	assert.Equal(t, PhaseIdle, status.Phase)
+	assert.Equal(t, true, status.CycleStart.IsZero())
+	assert.Equal(t, start, status.LastCycleStart)
+	assert.Equal(t, 2.0, status.LastCycleDuration)
+	assert.Equal(t, start.Add(2*time.Second), status.LastSuccess)
+	assert.Equal(t, 3, status.FilesListed)
+	assert.Equal(t, 2, status.FilesPulled)
+	assert.Equal(t, 1, status.FilesDeleted)
+	assert.Equal(t, 1, status.CacheSize)
+
+	// failures are counted until the next successful pull
+	for i := 1; i <= 2; i++ {
+		p.startCycle(start.Add(time.Duration(i) * time.Minute))
+		p.finishCycle("access denied", start.Add(time.Duration(i)*time.Minute))
+	}
+	status = p.Status()
+	assert.Equal(t, "access denied", status.LastError)
+	assert.Equal(t, 2, status.ConsecutiveFailures)
+	assert.Equal(t, start.Add(2*time.Second), status.LastSuccess)
+
+	p.startCycle(start.Add(time.Hour))
+	p.finishCycle("", start.Add(time.Hour))
+	status = p.Status()
+	assert.Equal(t, "", status.LastError)
+	assert.Equal(t, 0, status.ConsecutiveFailures)
+}
+
+func TestCheckLive(t *testing.T) {
+	start := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	interval := 5 * time.Second
+	maxDuration := time.Minute
+
+	status := PullStatus{}
+	assert.Equal(t, nil, status.CheckLive(start, interval, maxDuration))
+
+	status.CycleStart = start
+	assert.Equal(t, nil, status.CheckLive(start.Add(time.Minute), interval, maxDuration))
+	assert.NotEqual(t, nil, status.CheckLive(start.Add(2*time.Minute), interval, maxDuration))
+	// check is disabled
+	assert.Equal(t, nil, status.CheckLive(start.Add(2*time.Minute), interval, 0))
+
+	status.CycleStart = time.Time{}
+	status.LastCycleEnd = start
+	assert.Equal(t, nil, status.CheckLive(start.Add(interval), interval, maxDuration))
+	assert.NotEqual(t, nil, status.CheckLive(start.Add(2*time.Minute), interval, maxDuration))
+}
+
+func TestCheckReady(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	assert.Equal(t, nil, err)
+	defer os.RemoveAll(dir)
+
+	p, err := NewPuller("s3://foo/home", dir)
+	assert.Equal(t, nil, err)
+	start := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	assert.NotEqual(t, nil, p.Status().CheckReady(start, 0))
+
+	// waiting for the first commit doesn't finish initial pull
+	p.startCycle(start)
+	p.setWaitingForCommit(true)
+	p.finishCycle("", start)
+	assert.NotEqual(t, nil, p.Status().CheckReady(start, 0))
+
+	p.startCycle(start)
+	p.setWaitingForCommit(false)
+	p.appliedCommit = "\"1\""
+	p.finishCycle("", start)
+	assert.Equal(t, nil, p.Status().CheckReady(start, 0))
+
+	// unchanged commit marker means local dir is up to date
+	p.startCycle(start.Add(time.Minute))
+	p.setWaitingForCommit(true)
+	p.finishCycle("", start.Add(time.Minute))
+	assert.Equal(t, nil, p.Status().CheckReady(start.Add(2*time.Minute), 2*time.Minute))
+
+	p.startCycle(start.Add(2 * time.Minute))
+	p.finishCycle("access denied", start.Add(2*time.Minute))
+	assert.Equal(t, nil, p.Status().CheckReady(start.Add(3*time.Minute), 2*time.Minute))
+	assert.NotEqual(t, nil, p.Status().CheckReady(start.Add(4*time.Minute), 2*time.Minute))
+	assert.Equal(t, nil, p.Status().CheckReady(start.Add(4*time.Minute), 0))
+}
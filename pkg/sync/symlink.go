@@ -0,0 +1,56 @@
+package sync
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+const (
+	// user metadata (x-amz-meta-symlink-target) marking an object as symlink
+	metaKeySymlinkTarget = "symlink-target"
+	// rclone stores symlinks as objects with this suffix and the link target
+	// as content
+	rcloneLinkSuffix = ".rclonelink"
+)
+
+// validateSymlinkTarget makes sure symlink created at linkPath pointing to
+// target won't escape localDir. Symlinks along the way, including ones
+// created by earlier pulls in parent dirs of linkPath, are resolved before
+// the check.
+func validateSymlinkTarget(localDir string, linkPath string, target string) error {
+	if target == "" {
+		return fmt.Errorf("empty symlink target")
+	}
+
+	realDir, err := filepath.EvalSymlinks(localDir)
+	if err != nil {
+		return err
+	}
+	realDir, err = filepath.Abs(realDir)
+	if err != nil {
+		return err
+	}
+	linkDir, err := resolvePath(filepath.Dir(linkPath))
+	if err != nil {
+		return err
+	}
+	hops := 0
+	resolved, err := resolvePathFrom(linkDir, target, &hops)
+	if err != nil {
+		return err
+	}
+	if !isPathWithinDir(realDir, resolved) {
+		return fmt.Errorf("symlink target %s resolves to %s outside of %s", target, resolved, localDir)
+	}
+	return nil
+}
+
+// createTmpSymlink replaces file at tmpPath with a symlink to target, so it
+// can be renamed over the local path atomically.
+func createTmpSymlink(tmpPath string, target string) error {
+	if err := os.Remove(tmpPath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return os.Symlink(target, tmpPath)
+}
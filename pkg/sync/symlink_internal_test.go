@@ -0,0 +1,164 @@
+package sync
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCreateSymlinks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	assert.Equal(t, nil, err)
+	defer os.RemoveAll(dir)
+
+	p, err := NewPuller("s3://abc/efg", dir)
+	assert.Equal(t, nil, err)
+	p.Symlinks = true
+	p.errMsgQueue = make(chan string, 30)
+	assert.Equal(t, nil, p.SetupWorkingDir())
+
+	p.downloadHandler(
+		DownloadTask{
+			Uri:       "s3://abc/efg/team_a/helpers",
+			LocalPath: filepath.Join(dir, "team_a", "helpers"),
+			Uid:       "uid1",
+			UidKey:    "team_a/helpers",
+		},
+		MockDownloader{metadata: map[string]*string{"Symlink-Target": aws.String("../shared/helpers")}})
+	p.downloadHandler(
+		DownloadTask{
+			Uri:        "s3://abc/efg/team_b/helpers.rclonelink",
+			LocalPath:  filepath.Join(dir, "team_b", "helpers"),
+			Uid:        "uid2",
+			UidKey:     "team_b/helpers",
+			RcloneLink: true,
+		},
+		MockDownloader{content: "../shared/helpers"})
+	p.downloadHandler(
+		DownloadTask{
+			Uri:       "s3://abc/efg/evil",
+			LocalPath: filepath.Join(dir, "evil"),
+			Uid:       "uid3",
+			UidKey:    "evil",
+		},
+		MockDownloader{metadata: map[string]*string{"Symlink-Target": aws.String("/etc/passwd")}})
+	p.downloadHandler(
+		DownloadTask{
+			Uri:        "s3://abc/efg/evil2.rclonelink",
+			LocalPath:  filepath.Join(dir, "evil2"),
+			Uid:        "uid4",
+			UidKey:     "evil2",
+			RcloneLink: true,
+		},
+		MockDownloader{content: "../../etc/passwd"})
+	close(p.errMsgQueue)
+
+	messages := []string{}
+	for msg := range p.errMsgQueue {
+		messages = append(messages, msg)
+	}
+	assert.Equal(t, []string{}, messages)
+
+	for _, name := range []string{"team_a", "team_b"} {
+		target, err := os.Readlink(filepath.Join(dir, name, "helpers"))
+		assert.Equal(t, nil, err)
+		assert.Equal(t, "../shared/helpers", target)
+	}
+	for _, name := range []string{"evil", "evil2"} {
+		_, err = os.Lstat(filepath.Join(dir, name))
+		assert.True(t, os.IsNotExist(err))
+	}
+	assert.Equal(t, map[string]string{"team_a/helpers": "uid1", "team_b/helpers": "uid2"}, p.uidCache)
+	assert.Equal(t, 2, p.symlinkRejectedCnt)
+}
+
+func TestRcloneLinkObjects(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	assert.Equal(t, nil, err)
+	defer os.RemoveAll(dir)
+
+	p, err := NewPuller("s3://foo/home", dir)
+	assert.Equal(t, nil, err)
+	p.Symlinks = true
+	p.taskQueue = make(chan DownloadTask, 10)
+
+	var tasks []DownloadTask
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		for task := range p.taskQueue {
+			tasks = append(tasks, task)
+		}
+		wg.Done()
+	}()
+
+	p.handlePageList(
+		&s3.ListObjectsV2Output{
+			Contents: []*s3.Object{
+				&s3.Object{
+					Key:  aws.String("home/dags/helpers.rclonelink"),
+					ETag: aws.String("\"1\""),
+				},
+			},
+		},
+		false,
+		"foo",
+		"home",
+		dir,
+	)
+	close(p.taskQueue)
+	wg.Wait()
+
+	assert.Equal(t, 1, len(tasks))
+	assert.Equal(t, filepath.Join(dir, "dags", "helpers"), tasks[0].LocalPath)
+	assert.Equal(t, "dags/helpers", tasks[0].UidKey)
+	assert.True(t, tasks[0].RcloneLink)
+}
+
+func TestWalkDoesNotFollowSymlinks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	assert.Equal(t, nil, err)
+	defer os.RemoveAll(dir)
+
+	sharedDir := filepath.Join(dir, "shared")
+	os.MkdirAll(sharedDir, os.ModePerm)
+	helperFile := filepath.Join(sharedDir, "helper.py")
+	err = ioutil.WriteFile(helperFile, []byte("test"), 0644)
+	assert.Equal(t, nil, err)
+
+	link := filepath.Join(dir, "dags", "shared")
+	os.MkdirAll(filepath.Dir(link), os.ModePerm)
+	assert.Equal(t, nil, os.Symlink("../shared", link))
+
+	files, err := listAndPruneDir(dir, nil, true)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, map[string]bool{helperFile: true, link: true}, files)
+}
+
+func TestValidateSymlinkTargetUnderSymlink(t *testing.T) {
+	root, err := ioutil.TempDir("", "")
+	assert.Equal(t, nil, err)
+	defer os.RemoveAll(root)
+	dir := filepath.Join(root, "local")
+	assert.Equal(t, nil, os.MkdirAll(filepath.Join(dir, "deep", "er"), os.ModePerm))
+
+	// link to local dir itself is allowed
+	linkPath := filepath.Join(dir, "deep", "er", "a")
+	assert.Equal(t, nil, validateSymlinkTarget(dir, linkPath, "../.."))
+	assert.Equal(t, nil, os.Symlink("../..", linkPath))
+
+	// lexically deep/er/outside, but deep/er/a resolves to local dir
+	err = validateSymlinkTarget(dir, filepath.Join(linkPath, "esc"), "../../../outside")
+	assert.NotEqual(t, nil, err)
+	assert.Equal(t, nil, validateSymlinkTarget(dir, filepath.Join(linkPath, "ok"), "deep/er"))
+
+	// symlinks inside of the target are resolved as well
+	err = validateSymlinkTarget(dir, filepath.Join(dir, "b"), "deep/er/a/../outside")
+	assert.NotEqual(t, nil, err)
+}
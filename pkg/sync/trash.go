@@ -0,0 +1,56 @@
+package sync
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// SetTrash makes pulls move deleted files into a timestamped directory under
+// trashDir instead of removing them. Directories older than ttl are purged
+// at the end of each pull, ttl of 0 keeps them forever.
+func (self *Puller) SetTrash(trashDir string, ttl time.Duration) error {
+	trashDir, err := self.absDirOutsideLocalDir(trashDir)
+	if err != nil {
+		return fmt.Errorf("invalid trash dir: %v", err)
+	}
+	self.trashDir = trashDir
+	self.trashTTL = ttl
+	return nil
+}
+
+// moveToTrash moves deleted local file into trash dir of the current pull.
+func (self *Puller) moveToTrash(path string, relPath string) error {
+	return moveFile(path, filepath.Join(self.trashDir, self.trashId, relPath))
+}
+
+// purgeTrash removes trash directories created longer than trash TTL ago.
+func (self *Puller) purgeTrash(now time.Time) {
+	l := zap.S()
+
+	if self.trashTTL <= 0 {
+		return
+	}
+	entries, err := ioutil.ReadDir(self.trashDir)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			l.Errorf("Failed to list trash dir %s: %v", self.trashDir, err)
+		}
+		return
+	}
+	for _, entry := range entries {
+		created, err := time.Parse(historyIdFormat, entry.Name())
+		if err != nil || !entry.IsDir() {
+			// not created by objinsync
+			continue
+		}
+		if now.Sub(created) > self.trashTTL {
+			l.Debugf("Purging trash %s", entry.Name())
+			os.RemoveAll(filepath.Join(self.trashDir, entry.Name()))
+		}
+	}
+}
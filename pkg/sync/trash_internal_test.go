@@ -0,0 +1,50 @@
+package sync
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMoveToTrash(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	assert.Equal(t, nil, err)
+	defer os.RemoveAll(dir)
+
+	localDir := filepath.Join(dir, "dags")
+	trashDir := filepath.Join(dir, "trash")
+	assert.Equal(t, nil, os.MkdirAll(filepath.Join(localDir, "sub"), os.ModePerm))
+	assert.Equal(t, nil, ioutil.WriteFile(filepath.Join(localDir, "sub", "a.py"), []byte("a"), 0644))
+
+	p, err := NewPuller("s3://foo/home", localDir)
+	assert.Equal(t, nil, err)
+	assert.NotEqual(t, nil, p.SetTrash(filepath.Join(localDir, "trash"), time.Hour))
+	assert.Equal(t, nil, p.SetTrash(trashDir, time.Hour))
+
+	now := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	p.trashId = now.Format(historyIdFormat)
+	p.removeLocalFile(filepath.Join(localDir, "sub", "a.py"), filepath.Join("sub", "a.py"))
+
+	_, err = os.Stat(filepath.Join(localDir, "sub", "a.py"))
+	assert.True(t, os.IsNotExist(err))
+	content, err := ioutil.ReadFile(filepath.Join(trashDir, "20230101T000000.000Z", "sub", "a.py"))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "a", string(content))
+
+	// directories not created by objinsync are left alone
+	assert.Equal(t, nil, os.MkdirAll(filepath.Join(trashDir, "keep"), os.ModePerm))
+
+	p.purgeTrash(now.Add(time.Hour))
+	_, err = os.Stat(filepath.Join(trashDir, "20230101T000000.000Z"))
+	assert.Equal(t, nil, err)
+
+	p.purgeTrash(now.Add(time.Hour + time.Second))
+	_, err = os.Stat(filepath.Join(trashDir, "20230101T000000.000Z"))
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(filepath.Join(trashDir, "keep"))
+	assert.Equal(t, nil, err)
+}
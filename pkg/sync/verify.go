@@ -0,0 +1,177 @@
+package sync
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/service/s3"
+	"go.uber.org/zap"
+)
+
+// contentDigests holds expected digests of an object. Empty fields are not
+// verified.
+type contentDigests struct {
+	// hex encoded, only available for single part objects without KMS or
+	// customer provided key encryption
+	md5 string
+	// base64 encoded S3 additional checksums
+	crc32c string
+	sha256 string
+}
+
+func (self contentDigests) empty() bool {
+	return self.md5 == "" && self.crc32c == "" && self.sha256 == ""
+}
+
+// md5FromETag returns hex encoded MD5 digest of object content if it can be
+// derived from the ETag.
+func md5FromETag(etag string, head *s3.HeadObjectOutput) string {
+	etag = strings.Trim(etag, "\"")
+	// ETag of multipart objects has a -N suffix
+	if len(etag) != 32 || strings.Contains(etag, "-") {
+		return ""
+	}
+	if head != nil {
+		// ETag is not MD5 of content for objects encrypted with KMS or SSE-C
+		if head.SSECustomerAlgorithm != nil {
+			return ""
+		}
+		if head.ServerSideEncryption != nil && strings.HasPrefix(*head.ServerSideEncryption, "aws:kms") {
+			return ""
+		}
+	}
+	return strings.ToLower(etag)
+}
+
+// additional checksums of multipart objects are checksums of part checksums
+// with a -N suffix, they can't be verified against full content
+func fullObjectChecksum(checksum *string) string {
+	if checksum == nil || strings.Contains(*checksum, "-") {
+		return ""
+	}
+	return *checksum
+}
+
+func digestsFromHead(head *s3.HeadObjectOutput) contentDigests {
+	digests := contentDigests{
+		crc32c: fullObjectChecksum(head.ChecksumCRC32C),
+		sha256: fullObjectChecksum(head.ChecksumSHA256),
+	}
+	if head.ETag != nil {
+		digests.md5 = md5FromETag(*head.ETag, head)
+	}
+	return digests
+}
+
+// contentHashes computes all supported digests of content in one pass.
+type contentHashes struct {
+	md5    hash.Hash
+	crc32c hash.Hash32
+	sha256 hash.Hash
+}
+
+func newContentHashes() *contentHashes {
+	return &contentHashes{
+		md5:    md5.New(),
+		crc32c: crc32.New(crc32.MakeTable(crc32.Castagnoli)),
+		sha256: sha256.New(),
+	}
+}
+
+func (self *contentHashes) Write(p []byte) (int, error) {
+	self.md5.Write(p)
+	self.crc32c.Write(p)
+	self.sha256.Write(p)
+	return len(p), nil
+}
+
+func (self *contentHashes) hashFile(path string) error {
+	self.md5.Reset()
+	self.crc32c.Reset()
+	self.sha256.Reset()
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(self, f)
+	return err
+}
+
+func (self *contentHashes) digests() contentDigests {
+	return contentDigests{
+		md5:    hex.EncodeToString(self.md5.Sum(nil)),
+		crc32c: base64.StdEncoding.EncodeToString(self.crc32c.Sum(nil)),
+		sha256: base64.StdEncoding.EncodeToString(self.sha256.Sum(nil)),
+	}
+}
+
+// verify compares computed digests with expected ones.
+func (self *contentHashes) verify(expected contentDigests) error {
+	actual := self.digests()
+	if expected.md5 != "" && expected.md5 != actual.md5 {
+		return fmt.Errorf("md5 mismatch, expected %s, got %s", expected.md5, actual.md5)
+	}
+	if expected.crc32c != "" && expected.crc32c != actual.crc32c {
+		return fmt.Errorf("crc32c mismatch, expected %s, got %s", expected.crc32c, actual.crc32c)
+	}
+	if expected.sha256 != "" && expected.sha256 != actual.sha256 {
+		return fmt.Errorf("sha256 mismatch, expected %s, got %s", expected.sha256, actual.sha256)
+	}
+	return nil
+}
+
+// hashingWriterAt feeds content written through it into hashes as long as
+// writes are sequential, which is the case for objects downloaded in a single
+// part. Content needs to be hashed from the written file otherwise.
+type hashingWriterAt struct {
+	w          io.WriterAt
+	hashes     *contentHashes
+	offset     int64
+	sequential bool
+	lock       sync.Mutex
+}
+
+func newHashingWriterAt(w io.WriterAt, hashes *contentHashes) *hashingWriterAt {
+	return &hashingWriterAt{w: w, hashes: hashes, sequential: true}
+}
+
+func (self *hashingWriterAt) WriteAt(p []byte, off int64) (int, error) {
+	n, err := self.w.WriteAt(p, off)
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.sequential && off == self.offset {
+		self.hashes.Write(p[:n])
+		self.offset += int64(n)
+	} else {
+		self.sequential = false
+	}
+	return n, err
+}
+
+// verifyDownload checks content written through writer to path against
+// digests from object metadata.
+func verifyDownload(path string, writer *hashingWriterAt, head *s3.HeadObjectOutput) error {
+	expected := digestsFromHead(head)
+	if expected.empty() {
+		zap.S().Debugf("No digest available to verify %s", path)
+		return nil
+	}
+	if !writer.sequential {
+		if err := writer.hashes.hashFile(path); err != nil {
+			return err
+		}
+	}
+	return writer.hashes.verify(expected)
+}
@@ -0,0 +1,117 @@
+package sync
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMd5FromETag(t *testing.T) {
+	etag := "\"5D41402ABC4B2A76B9719D911017C592\""
+	assert.Equal(t, "5d41402abc4b2a76b9719d911017c592", md5FromETag(etag, nil))
+	assert.Equal(t, "", md5FromETag("\"5d41402abc4b2a76b9719d911017c592-3\"", nil))
+	assert.Equal(t, "", md5FromETag("\"1\"", nil))
+	assert.Equal(t, "", md5FromETag(etag, &s3.HeadObjectOutput{
+		ServerSideEncryption: aws.String("aws:kms"),
+	}))
+	assert.Equal(t, "", md5FromETag(etag, &s3.HeadObjectOutput{
+		SSECustomerAlgorithm: aws.String("AES256"),
+	}))
+}
+
+func TestHashingWriterAt(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	assert.Equal(t, nil, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "a")
+	expected := contentDigests{md5: fmt.Sprintf("%x", md5.Sum([]byte("hello world")))}
+
+	f, err := os.Create(path)
+	assert.Equal(t, nil, err)
+	w := newHashingWriterAt(f, newContentHashes())
+	w.WriteAt([]byte("hello "), 0)
+	w.WriteAt([]byte("world"), 6)
+	f.Close()
+	assert.True(t, w.sequential)
+	assert.Equal(t, nil, w.hashes.verify(expected))
+
+	// out of order writes fall back to hashing the file
+	f, err = os.Create(path)
+	assert.Equal(t, nil, err)
+	w = newHashingWriterAt(f, newContentHashes())
+	w.WriteAt([]byte("world"), 6)
+	w.WriteAt([]byte("hello "), 0)
+	f.Close()
+	assert.False(t, w.sequential)
+	assert.NotEqual(t, nil, w.hashes.verify(expected))
+	assert.Equal(t, nil, verifyDownload(path, w, &s3.HeadObjectOutput{
+		ETag: aws.String(fmt.Sprintf("\"%s\"", expected.md5)),
+	}))
+}
+
+func TestVerifyDownload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	assert.Equal(t, nil, err)
+	defer os.RemoveAll(dir)
+
+	p, err := NewPuller("s3://abc/efg", dir)
+	assert.Equal(t, nil, err)
+	p.Verify = true
+	p.errMsgQueue = make(chan string, 30)
+	assert.Equal(t, nil, p.SetupWorkingDir())
+
+	content := "print('hello')"
+	etag := fmt.Sprintf("\"%x\"", md5.Sum([]byte(content)))
+	sum := sha256.Sum256([]byte(content))
+	checksum := base64.StdEncoding.EncodeToString(sum[:])
+
+	p.downloadHandler(
+		DownloadTask{
+			Uri:       "s3://abc/efg/good.py",
+			LocalPath: filepath.Join(dir, "good.py"),
+			Uid:       etag,
+			UidKey:    "good.py",
+		},
+		MockDownloader{content: content, etag: etag, sha256: checksum})
+	p.downloadHandler(
+		DownloadTask{
+			Uri:       "s3://abc/efg/bad_md5.py",
+			LocalPath: filepath.Join(dir, "bad_md5.py"),
+			Uid:       "\"5d41402abc4b2a76b9719d911017c592\"",
+			UidKey:    "bad_md5.py",
+		},
+		MockDownloader{content: content, etag: "\"5d41402abc4b2a76b9719d911017c592\""})
+	p.downloadHandler(
+		DownloadTask{
+			Uri:       "s3://abc/efg/bad_sha256.py",
+			LocalPath: filepath.Join(dir, "bad_sha256.py"),
+			Uid:       "\"1-2\"",
+			UidKey:    "bad_sha256.py",
+		},
+		MockDownloader{content: content, etag: "\"1-2\"", sha256: "invalid"})
+	close(p.errMsgQueue)
+
+	messages := []string{}
+	for msg := range p.errMsgQueue {
+		messages = append(messages, msg)
+	}
+	assert.Equal(t, 2, len(messages))
+
+	_, err = os.Stat(filepath.Join(dir, "good.py"))
+	assert.Equal(t, nil, err)
+	for _, name := range []string{"bad_md5.py", "bad_sha256.py"} {
+		_, err = os.Stat(filepath.Join(dir, name))
+		assert.True(t, os.IsNotExist(err))
+	}
+	assert.Equal(t, map[string]string{"good.py": etag}, p.uidCache)
+}
@@ -0,0 +1,89 @@
+package sync
+
+import (
+	"sort"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+type GenericVersionLister interface {
+	ListObjectVersionsPages(*s3.ListObjectVersionsInput, func(*s3.ListObjectVersionsOutput, bool) bool) error
+}
+
+// selectVersionsAsOf returns objects as they existed at given time together
+// with version ids by key. Keys whose latest version at that time is a delete
+// marker are left out.
+func selectVersionsAsOf(
+	versions []*s3.ObjectVersion,
+	markers []*s3.DeleteMarkerEntry,
+	asOf time.Time,
+) (*s3.ListObjectsV2Output, map[string]string) {
+	latest := map[string]*s3.ObjectVersion{}
+	for _, v := range versions {
+		if v.Key == nil || v.LastModified == nil || v.LastModified.After(asOf) {
+			continue
+		}
+		if cur, ok := latest[*v.Key]; !ok || v.LastModified.After(*cur.LastModified) {
+			latest[*v.Key] = v
+		}
+	}
+
+	for _, m := range markers {
+		if m.Key == nil || m.LastModified == nil || m.LastModified.After(asOf) {
+			continue
+		}
+		// object deleted at or after its latest version
+		if cur, ok := latest[*m.Key]; ok && !m.LastModified.Before(*cur.LastModified) {
+			delete(latest, *m.Key)
+		}
+	}
+
+	keys := make([]string, 0, len(latest))
+	for key := range latest {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	page := &s3.ListObjectsV2Output{}
+	versionIds := make(map[string]string, len(keys))
+	for _, key := range keys {
+		v := latest[key]
+		page.Contents = append(page.Contents, &s3.Object{
+			Key:          v.Key,
+			ETag:         v.ETag,
+			Size:         v.Size,
+			LastModified: v.LastModified,
+		})
+		versionIds[key] = aws.StringValue(v.VersionId)
+	}
+	return page, versionIds
+}
+
+// listObjectsAsOf lists all versions under the remote prefix and selects the
+// ones that were current at AsOf.
+func (self *Puller) listObjectsAsOf(
+	svc GenericVersionLister,
+	bucket string,
+	remoteDirPath string,
+) (*s3.ListObjectsV2Output, error) {
+	var versions []*s3.ObjectVersion
+	var markers []*s3.DeleteMarkerEntry
+	input := &s3.ListObjectVersionsInput{
+		Bucket: aws.String(bucket),
+		Prefix: aws.String(remoteDirPath),
+	}
+	err := svc.ListObjectVersionsPages(input, func(page *s3.ListObjectVersionsOutput, lastPage bool) bool {
+		versions = append(versions, page.Versions...)
+		markers = append(markers, page.DeleteMarkers...)
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	page, versionIds := selectVersionsAsOf(versions, markers, self.AsOf)
+	self.versionIds = versionIds
+	return page, nil
+}
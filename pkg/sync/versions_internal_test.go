@@ -0,0 +1,118 @@
+package sync
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/stretchr/testify/assert"
+)
+
+type MockVersionLister struct {
+	pages []*s3.ListObjectVersionsOutput
+}
+
+func (self MockVersionLister) ListObjectVersionsPages(
+	input *s3.ListObjectVersionsInput,
+	fn func(*s3.ListObjectVersionsOutput, bool) bool,
+) error {
+	for i, page := range self.pages {
+		if !fn(page, i == len(self.pages)-1) {
+			break
+		}
+	}
+	return nil
+}
+
+func objectVersion(key string, versionId string, modified time.Time) *s3.ObjectVersion {
+	return &s3.ObjectVersion{
+		Key:          aws.String(key),
+		VersionId:    aws.String(versionId),
+		ETag:         aws.String("\"" + versionId + "\""),
+		Size:         aws.Int64(1),
+		LastModified: aws.Time(modified),
+	}
+}
+
+func TestSelectVersionsAsOf(t *testing.T) {
+	t0 := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	hour := time.Hour
+
+	versions := []*s3.ObjectVersion{
+		objectVersion("home/a.py", "a3", t0.Add(3*hour)),
+		objectVersion("home/a.py", "a2", t0.Add(2*hour)),
+		objectVersion("home/a.py", "a1", t0.Add(hour)),
+		// created after the point in time
+		objectVersion("home/b.py", "b1", t0.Add(4*hour)),
+		objectVersion("home/c.py", "c1", t0.Add(hour)),
+		objectVersion("home/d.py", "d1", t0.Add(hour)),
+	}
+	markers := []*s3.DeleteMarkerEntry{
+		// deleted before the point in time
+		&s3.DeleteMarkerEntry{Key: aws.String("home/c.py"), LastModified: aws.Time(t0.Add(2 * hour))},
+		// deleted after the point in time
+		&s3.DeleteMarkerEntry{Key: aws.String("home/d.py"), LastModified: aws.Time(t0.Add(4 * hour))},
+	}
+
+	page, versionIds := selectVersionsAsOf(versions, markers, t0.Add(2*hour+time.Minute))
+	keys := []string{}
+	for _, obj := range page.Contents {
+		keys = append(keys, *obj.Key)
+	}
+	assert.Equal(t, []string{"home/a.py", "home/d.py"}, keys)
+	assert.Equal(t, "\"a2\"", *page.Contents[0].ETag)
+	assert.Equal(t, map[string]string{"home/a.py": "a2", "home/d.py": "d1"}, versionIds)
+
+	page, versionIds = selectVersionsAsOf(versions, markers, t0)
+	assert.Equal(t, 0, len(page.Contents))
+	assert.Equal(t, map[string]string{}, versionIds)
+}
+
+func TestPullAsOfDownloadsVersion(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	assert.Equal(t, nil, err)
+	defer os.RemoveAll(dir)
+
+	t0 := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	p, err := NewPuller("s3://foo/home", dir)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, nil, p.SetupWorkingDir())
+	p.AsOf = t0.Add(time.Hour)
+
+	// versions of a key can span multiple pages
+	page, err := p.listObjectsAsOf(MockVersionLister{[]*s3.ListObjectVersionsOutput{
+		&s3.ListObjectVersionsOutput{Versions: []*s3.ObjectVersion{
+			objectVersion("home/a.py", "a2", t0.Add(2*time.Hour)),
+		}},
+		&s3.ListObjectVersionsOutput{Versions: []*s3.ObjectVersion{
+			objectVersion("home/a.py", "a1", t0),
+		}},
+	}}, "foo", "home")
+	assert.Equal(t, nil, err)
+
+	p.taskQueue = make(chan DownloadTask, 10)
+	p.handlePageList(page, true, "foo", "home", dir)
+	close(p.taskQueue)
+	task := <-p.taskQueue
+	assert.Equal(t, "a1", task.VersionId)
+	assert.Equal(t, "\"a1\"", task.Uid)
+
+	p.errMsgQueue = make(chan string, 30)
+	downloader := &RecordingDownloader{MockDownloader: MockDownloader{content: "a"}}
+	p.Verify = true
+	p.downloadHandler(task, downloader)
+	close(p.errMsgQueue)
+	for msg := range p.errMsgQueue {
+		assert.Fail(t, msg)
+	}
+	assert.Equal(t, "a1", *downloader.headInputs[0].VersionId)
+	assert.Equal(t, "a1", *downloader.getInputs[0].VersionId)
+
+	content, err := ioutil.ReadFile(filepath.Join(dir, "a.py"))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "a", string(content))
+}